@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"time"
+
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/images"
+	"greenlight.usman.com/internal/validator"
+)
+
+// readUpload reads an uploaded file. It is either the raw request body, or the part named
+// file of a multipart/form-data body. Unlike readJSON() the limit comes from the
+// storage-max-upload-bytes setting, as images are a lot bigger than our JSON bodies
+func (app *application) readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	maxBytes := app.config.storage.maxUploadBytes
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	var src io.Reader = r.Body
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		mr := multipart.NewReader(r.Body, params["boundary"])
+
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				var maxBytesError *http.MaxBytesError
+				switch {
+				case errors.Is(err, io.EOF):
+					return nil, errors.New("body must contain a part named file")
+				case errors.As(err, &maxBytesError):
+					return nil, fmt.Errorf("file must not be larger than %d bytes", maxBytes)
+				default:
+					return nil, fmt.Errorf("body contains badly-formed multipart data: %w", err)
+				}
+			}
+
+			if part.FormName() == "file" {
+				src = part
+				break
+			}
+		}
+	}
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			return nil, fmt.Errorf("file must not be larger than %d bytes", maxBytes)
+		default:
+			return nil, err
+		}
+	}
+
+	if len(body) == 0 {
+		return nil, errors.New("file must not be empty")
+	}
+
+	return body, nil
+}
+
+// processImage runs images.Process() once one of the imageSlots is free. Even within the
+// pixel limits a decoded image can take a few hundred MB, so only -storage-max-processing
+// uploads are decoded at once and the rest wait their turn, or give up if the request is
+// cancelled first
+func (app *application) processImage(ctx context.Context, body []byte, widths []int) ([]images.Variant, error) {
+	select {
+	case app.imageSlots <- struct{}{}:
+		defer func() { <-app.imageSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return images.Process(body, widths)
+}
+
+// uploadArtworkHandler returns the handler for PUT /v1/movies/:id/poster and
+// PUT /v1/movies/:id/backdrop. The image is checked by sniffing its content, thumbnails are
+// generated, and everything is stored under keys containing a hash of the upload, so a new
+// image always gets new URLs and they can be cached forever
+func (app *application) uploadArtworkHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		// check the movie exists before we go to the trouble of reading the image
+		_, err = app.models.Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		body, err := app.readUpload(w, r)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		variants, err := app.processImage(r.Context(), body, data.ArtworkSizes[kind])
+		if err != nil {
+			switch {
+			case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+				// the client went away while waiting for a slot, there's no one to answer
+				return
+			case errors.Is(err, images.ErrUnsupportedType), errors.Is(err, images.ErrTooManyPixels):
+				v := validator.New()
+				v.AddError("file", err.Error())
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		hash := sha256.Sum256(body)
+		prefix := fmt.Sprintf("movies/%d/%s/%s", id, kind, hex.EncodeToString(hash[:8]))
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		stored := make([]data.ArtworkImage, 0, len(variants))
+		for _, variant := range variants {
+			image := data.ArtworkImage{
+				MovieID:     id,
+				Kind:        kind,
+				Variant:     variant.Name,
+				Key:         fmt.Sprintf("%s-%s.%s", prefix, variant.Name, variant.Ext),
+				ContentType: variant.ContentType,
+				Width:       variant.Width,
+				Height:      variant.Height,
+			}
+
+			err = app.blobs.Put(ctx, image.Key, variant.Body, variant.ContentType)
+			if err != nil {
+				app.deleteBlobs(keysOf(stored))
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			stored = append(stored, image)
+		}
+
+		old, err := app.models.Artwork.Replace(id, kind, stored)
+		if err != nil {
+			app.deleteBlobs(keysOf(stored))
+
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// uploading the same image again gives the same keys, those mustn't be deleted
+		app.deleteBlobs(without(old, keysOf(stored)))
+
+		err = app.writeJSON(w, http.StatusOK, envelop{kind: app.artworkURLs(stored)}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// deleteArtworkHandler returns the handler for DELETE /v1/movies/:id/poster and
+// DELETE /v1/movies/:id/backdrop
+func (app *application) deleteArtworkHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		keys, err := app.models.Artwork.Delete(id, kind)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.deleteBlobs(keys)
+
+		err = app.writeJSON(w, http.StatusOK, envelop{"message": kind + " successfully deleted"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// includeArtwork fills in the poster and backdrop URLs of the movies, using a single query
+func (app *application) includeArtwork(movies ...*data.Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(movies))
+	for _, movie := range movies {
+		ids = append(ids, movie.ID)
+	}
+
+	artwork, err := app.models.Artwork.GetForMovies(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		var posters, backdrops []data.ArtworkImage
+
+		for _, image := range artwork[movie.ID] {
+			switch image.Kind {
+			case "poster":
+				posters = append(posters, image)
+			case "backdrop":
+				backdrops = append(backdrops, image)
+			}
+		}
+
+		movie.Poster = app.artworkURLs(posters)
+		movie.Backdrop = app.artworkURLs(backdrops)
+	}
+
+	return nil
+}
+
+// artworkURLs maps each variant of the images to its URL, or returns nil if there are none
+func (app *application) artworkURLs(artwork []data.ArtworkImage) data.Artwork {
+	if len(artwork) == 0 {
+		return nil
+	}
+
+	urls := make(data.Artwork, len(artwork))
+	for _, image := range artwork {
+		urls[image.Variant] = app.blobs.URL(image.Key)
+	}
+
+	return urls
+}
+
+// deleteBlobs queues a job to remove the blobs. A failure only leaves an orphaned file
+// behind, so it is logged rather than failing the request
+func (app *application) deleteBlobs(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	err := app.enqueue(jobDeleteBlobs, deleteBlobsJob{Keys: keys})
+	if err != nil {
+		app.logger.Error(err.Error(), "keys", keys)
+	}
+}
+
+func keysOf(artwork []data.ArtworkImage) []string {
+	keys := make([]string, 0, len(artwork))
+	for _, image := range artwork {
+		keys = append(keys, image.Key)
+	}
+
+	return keys
+}
+
+// without returns the keys which aren't in exclude
+func without(keys, exclude []string) []string {
+	kept := []string{}
+	for _, key := range keys {
+		if !slices.Contains(exclude, key) {
+			kept = append(kept, key)
+		}
+	}
+
+	return kept
+}
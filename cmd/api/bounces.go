@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/validator"
+)
+
+// emailBounceHandler handles POST /v1/email/bounces, which our mail provider calls when an
+// email bounces or the recipient marks it as spam. Permanent bounces and complaints add the
+// address to the suppression list, so that the mailer stops sending to it. Transient bounces
+// (eg a full mailbox) are acknowledged and otherwise ignored.
+//
+// The provider authenticates with the shared secret from -mailer-bounce-secret in the
+// X-Greenlight-Bounce-Secret header. Without a secret configured the endpoint doesn't exist
+func (app *application) emailBounceHandler(w http.ResponseWriter, r *http.Request) {
+	if app.config.mailer.bounceSecret == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// compare in constant time so that the secret can't be guessed a byte at a time
+	secret := r.Header.Get("X-Greenlight-Bounce-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(app.config.mailer.bounceSecret)) != 1 {
+		app.errorResponse(w, r, http.StatusUnauthorized, "invalid or missing bounce secret")
+		return
+	}
+
+	var input struct {
+		Type       string `json:"type"`
+		Email      string `json:"email"`
+		BounceType string `json:"bounce_type"`
+		Detail     string `json:"detail"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.Type = strings.ToLower(input.Type)
+	input.BounceType = strings.ToLower(input.BounceType)
+	if input.BounceType == "" {
+		input.BounceType = "permanent"
+	}
+
+	v := validator.New()
+
+	v.Check(validator.PermittedValue(input.Type, data.SuppressionBounce, data.SuppressionComplaint), "type", "must be bounce or complaint")
+	v.Check(validator.PermittedValue(input.BounceType, "permanent", "transient"), "bounce_type", "must be permanent or transient")
+
+	suppression := &data.Suppression{
+		Email:  input.Email,
+		Reason: input.Type,
+		Detail: input.Detail,
+	}
+
+	if data.ValidateSuppression(v, suppression); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// a transient bounce may well succeed next time, so the address isn't suppressed
+	if input.Type == data.SuppressionBounce && input.BounceType == "transient" {
+		err = app.writeJSON(w, http.StatusOK, envelop{"message": "transient bounce ignored"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Suppressions.Insert(suppression)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("email address suppressed", "reason", suppression.Reason)
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"suppression": suppression}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createSuppressionHandler handles POST /v1/email/suppressions, which suppresses an address by
+// hand, eg when its owner asks us to stop emailing them
+func (app *application) createSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email  string `json:"email"`
+		Detail string `json:"detail"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	suppression := &data.Suppression{
+		Email:  input.Email,
+		Reason: data.SuppressionManual,
+		Detail: input.Detail,
+	}
+
+	v := validator.New()
+
+	if data.ValidateSuppression(v, suppression); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Suppressions.Insert(suppression)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelop{"suppression": suppression}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSuppressionHandler handles DELETE /v1/email/suppressions/:email, which lifts the
+// suppression of an address, eg once a mailbox which bounced works again
+func (app *application) deleteSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	email := httprouter.ParamsFromContext(r.Context()).ByName("email")
+
+	err := app.models.Suppressions.Delete(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "suppression successfully lifted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
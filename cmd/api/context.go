@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"greenlight.usman.com/internal/data"
+)
+
+// contextKey is our own type for the request context keys, so they can't collide with keys
+// set by any other package
+type contextKey string
+
+// userContextKey is the key for getting and setting the user in the request context
+const userContextKey = contextKey("user")
+
+// contextSetUser returns a copy of the request with the user added to its context
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the user from the request context. The only time it would be
+// missing is if the authenticate middleware didn't run, which is a bug, so we panic
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"greenlight.usman.com/internal/data"
+)
+
+const (
+	// webhookBatchSize is the most events fanned out, and the most deliveries sent at once,
+	// on each pass of the dispatcher
+	webhookBatchSize = 20
+	// the first retry of a failed delivery is after webhookBaseBackoff, and each retry after
+	// that waits twice as long as the one before, up to webhookMaxBackoff
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+)
+
+// webhookBackoff returns how long to wait before the next attempt, after the given number
+// of attempts have failed
+func webhookBackoff(attempts int32) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := int32(1); i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, webhookMaxBackoff)
+}
+
+// signWebhook returns the X-Greenlight-Signature header for a delivery. It is the same form
+// as Stripe uses: t is the unix time the delivery was sent and v1 the hex HMAC-SHA256 of
+// "<t>.<body>" with the webhook's secret. Including the time stops a captured request from
+// being replayed later, as receivers can reject a signature that is too old
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatchWebhooks runs until ctx is cancelled, moving events from the outbox into deliveries
+// and sending the deliveries which are due. It is started by serve() and stopped when the
+// server shuts down, a batch which is being sent is finished first
+func (app *application) dispatchWebhooks(ctx context.Context) {
+	// redirects aren't followed, a webhook URL that redirects is treated as a failure
+	client := &http.Client{
+		Timeout: app.config.webhooks.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ticker := time.NewTicker(app.config.webhooks.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// keep going without waiting while there is a full batch of work
+		sent := app.dispatchWebhookBatch(client)
+		if sent == webhookBatchSize && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchWebhookBatch fans out the next events and sends the deliveries which are due, in
+// parallel. It returns the number of deliveries sent
+func (app *application) dispatchWebhookBatch(client *http.Client) int {
+	_, err := app.models.Webhooks.FanOut(webhookBatchSize)
+	if err != nil {
+		app.logger.Error("webhook fan out", "error", err.Error())
+	}
+
+	// the lease covers the request and leaves plenty of time to record the result
+	deliveries, err := app.models.Webhooks.Claim(webhookBatchSize, app.config.webhooks.timeout+time.Minute)
+	if err != nil {
+		app.logger.Error("webhook claim", "error", err.Error())
+		return 0
+	}
+
+	var wg sync.WaitGroup
+
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.sendWebhook(client, delivery)
+		}()
+	}
+
+	wg.Wait()
+
+	return len(deliveries)
+}
+
+// sendWebhook makes one attempt at a delivery and records the result. Any 2xx response
+// counts as delivered, anything else is retried until the attempts run out
+func (app *application) sendWebhook(client *http.Client, delivery *data.OutgoingDelivery) {
+	status, err := app.postWebhook(client, delivery)
+
+	switch {
+	case err == nil:
+		err = app.models.Webhooks.MarkDelivered(delivery.ID, status)
+	case int(delivery.Attempts) >= app.config.webhooks.maxAttempts:
+		app.logger.Warn("webhook delivery failed", "delivery", delivery.ID, "webhook", delivery.WebhookID, "attempts", delivery.Attempts, "error", err.Error())
+		err = app.models.Webhooks.MarkFailed(delivery.ID, status, err.Error())
+	default:
+		err = app.models.Webhooks.MarkRetry(delivery.ID, status, err.Error(), webhookBackoff(delivery.Attempts))
+	}
+
+	if err != nil {
+		app.logger.Error("webhook delivery", "delivery", delivery.ID, "error", err.Error())
+	}
+}
+
+// postWebhook POSTs the delivery to the webhook's URL. It returns the response status (or 0
+// if there was no response) and an error unless the status was 2xx
+func (app *application) postWebhook(client *http.Client, delivery *data.OutgoingDelivery) (int, error) {
+	body, err := delivery.Body()
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Greenlight-Webhooks/"+version)
+	req.Header.Set("X-Greenlight-Event", delivery.EventType)
+	req.Header.Set("X-Greenlight-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Greenlight-Signature", signWebhook(delivery.Secret, time.Now(), body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// read (some of) the body so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected response status %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
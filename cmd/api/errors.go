@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 )
@@ -84,3 +85,58 @@ func (app *application) rateLimitExceededResponse(
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
+
+// timeoutMessage is the body sent when a handler runs past its time limit. http.TimeoutHandler
+// writes it as-is, so it has to be the already-encoded JSON envelope
+var timeoutMessage = func() string {
+	js, _ := json.MarshalIndent(envelop{"error": "the server took too long to process your request"}, "", "\t")
+	return string(js) + "\n"
+}()
+
+// Invalid email or password when creating an authentication token
+func (app *application) invalidCredentialsResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// The Authorization header had a token that is malformed, unknown or expired. The
+// WWW-Authenticate header tells the client we expect a bearer token
+func (app *application) invalidAuthenticationTokenResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// The endpoint needs an authenticated user but the request was anonymous
+func (app *application) authenticationRequiredResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// The user is authenticated but hasn't activated their account yet
+func (app *application) inactiveAccountResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	message := "your user account must be activated to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The user is authenticated but doesn't have the permission the endpoint needs
+func (app *application) notPermittedResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -1,22 +1,200 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
+
+	"greenlight.usman.com/migrations"
+)
+
+const (
+	// healthcheckTimeout is how long each readiness check gets before it is reported as down
+	healthcheckTimeout = 2 * time.Second
+	// mailerCheckTTL is how long the result of the mailer check is reused for. Probes come
+	// every few seconds and we don't want each of them to open a connection to the mail relay
+	mailerCheckTTL = 30 * time.Second
 )
 
+// healthcheckHandler handles GET /v1/healthcheck. It is kept for the clients which used it
+// before the live and ready endpoints existed, and reports the same as the readiness check,
+// so its status is no longer "available" when a dependency is down
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	app.readinessHandler(w, r)
+}
+
+// livenessHandler reports that the process is up and able to serve requests. It does
+// not look at any dependencies, a failing database should not get the process restarted
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelop{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// componentHealth is the result of checking a single dependency
+type componentHealth struct {
+	status  string
+	latency time.Duration
+	// critical components make the whole service unavailable when they are down
+	critical bool
+}
+
+// readinessHandler checks each of our dependencies and reports whether we should be sent
+// traffic. The database and the migrations are critical, if either of them is down we
+// return a 503. SMTP is only used in the background so a failure there reports the service
+// as degraded but still ready. While the server is draining during a graceful shutdown we
+// always return a 503, so that load balancers stop routing new requests to us. Anyone can
+// call this, so each component only reports its status and latency. Why a check failed
+// (which can name internal hosts and ports) is logged rather than sent
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if app.draining.Load() {
+		env := envelop{"status": "draining"}
+		err := app.writeJSON(w, http.StatusServiceUnavailable, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	checks := map[string]func(context.Context) error{
+		"database":   app.checkDatabase,
+		"migrations": app.checkMigrations,
+		"mailer":     app.checkMailer,
+	}
+	critical := map[string]bool{"database": true, "migrations": true}
+
+	// run the checks concurrently, so the response takes as long as the slowest check
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]componentHealth)
+	)
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), healthcheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+
+			result := componentHealth{
+				status:   "up",
+				latency:  time.Since(start),
+				critical: critical[name],
+			}
+			if err != nil {
+				result.status = "down"
+				app.logger.Warn("readiness check failed", "component", name, "error", err.Error())
+			}
+
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	status := "available"
+	code := http.StatusOK
+	components := make(map[string]any, len(results))
+
+	for name, result := range results {
+		if result.status != "up" {
+			if result.critical {
+				status = "unavailable"
+				code = http.StatusServiceUnavailable
+			} else if status == "available" {
+				status = "degraded"
+			}
+		}
+
+		components[name] = map[string]any{
+			"status":  result.status,
+			"latency": result.latency.String(),
+		}
+	}
 
 	env := envelop{
-		"status": "available",
+		"status":     status,
+		"components": components,
 		"system_info": map[string]string{
-			"environent": app.config.env,
-			"version":    version,
+			"environment": app.config.env,
+			"version":     version,
 		},
 	}
 
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err := app.writeJSON(w, code, env, nil)
 	if err != nil {
-		app.logger.Error(err.Error())
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// checkDatabase pings the connection pool
+func (app *application) checkDatabase(ctx context.Context) error {
+	return app.db.PingContext(ctx)
+}
+
+// checkMigrations compares the applied schema version with the latest migration we ship
+func (app *application) checkMigrations(ctx context.Context) error {
+	latest, err := migrations.Latest()
+	if err != nil {
+		return err
+	}
+
+	current, dirty, err := app.models.Schema.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("migration %d is dirty", current)
+	case current < latest:
+		return fmt.Errorf("%d pending migrations (at %d, latest is %d)", latest-current, current, latest)
+	}
+
+	return nil
+}
+
+// checkMailer pings the mailer's transport, for SMTP this opens (and closes) a connection to
+// the server. The result is cached for mailerCheckTTL
+func (app *application) checkMailer(ctx context.Context) error {
+	err := app.mailerCheck.run(ctx, mailerCheckTTL, app.mailer.Ping)
+	if err != nil {
+		return fmt.Errorf("%s transport: %w", app.config.mailer.transport, err)
+	}
+
+	return nil
+}
+
+// cachedCheck remembers the result of a check so that it is only run once per TTL, however
+// often it is asked for. The zero value is ready to use
+type cachedCheck struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// run returns the cached result if it is newer than the ttl, otherwise it runs the check. The
+// lock is held while checking, so concurrent probes wait for the one check in progress
+func (c *cachedCheck) run(ctx context.Context, ttl time.Duration, check func(context.Context) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < ttl {
+		return c.err
+	}
+
+	c.err = check(ctx)
+	c.checkedAt = time.Now()
+
+	return c.err
+}
@@ -7,16 +7,23 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.usman.com/internal/data"
 	"greenlight.usman.com/internal/validator"
 )
 
 type envelop map[string]any
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readInt64Param(r, "id")
+}
+
+// readInt64Param works like readIDParam() for any named URL parameter, eg :credit_id
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
 	// When httprouter is parsing a request, any interpolated URL parameters will be stored
 	// in the request context. We can use the ParamsFromContext() function to retrieve a slice
 	// containing these parameter names and values
@@ -27,9 +34,9 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	// by ByName() is always a string. So we try to convert it to a base 10 integer (with a bit size of 64)
 	// If the parameter could not be converted or is less then 1 we know the ID in invalid.
 	// So we use http.NotFound() function to return a 404
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
@@ -177,6 +184,238 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// canonicaliseGenreFilters turns the values of any genres filters into genre slugs, so that
+// genres=Sci-Fi matches the movies stored with sci-fi. The taxonomy is only read when there
+// is a genres filter
+func (app *application) canonicaliseGenreFilters(filters *data.Filters) error {
+	if !slices.ContainsFunc(filters.Conditions, func(c data.FilterCondition) bool { return c.Field == "genres" }) {
+		return nil
+	}
+
+	genres, err := app.models.Genres.Taxonomy()
+	if err != nil {
+		return err
+	}
+
+	genres.CanonicaliseConditions(filters.Conditions)
+
+	return nil
+}
+
+// The readBool() helper reads an optional true/false value from the query string. It returns
+// nil if the key is missing, and records an error in the validator if the value isn't a boolean
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+
+	return &b
+}
+
+// readLanguage picks the language to send the movie titles in: the lang query parameter if
+// there is one, otherwise the best match for the Accept-Language header, otherwise
+// data.DefaultLanguage. A lang that isn't supported is recorded in the validator. As the
+// response depends on the header, Vary is set here, the handler sets Content-Language once it
+// knows which languages it is sending, see contentLanguage()
+func (app *application) readLanguage(w http.ResponseWriter, r *http.Request, v *validator.Validator) string {
+	w.Header().Add("Vary", "Accept-Language")
+
+	lang := r.URL.Query().Get("lang")
+	if lang != "" {
+		lang = strings.ToLower(lang)
+		data.ValidateLanguage(v, "lang", lang)
+		return lang
+	}
+
+	return negotiateLanguage(r.Header.Get("Accept-Language"))
+}
+
+// contentLanguage returns the Content-Language header for the movies: the languages their
+// titles were actually sent in, which is the original language of any movie that hasn't been
+// translated into the one asked for. The languages are listed once each, in order, and it is
+// empty if none of them are known, in which case the header is left out
+func contentLanguage(movies ...*data.Movie) string {
+	languages := []string{}
+	for _, movie := range movies {
+		if movie.Language() != "" && !slices.Contains(languages, movie.Language()) {
+			languages = append(languages, movie.Language())
+		}
+	}
+
+	return strings.Join(languages, ", ")
+}
+
+// readRuntimeFormat returns the format to write the movie runtimes in. It is taken from the
+// runtime_format query parameter, or from a "Prefer: runtime-format=iso8601" header (see
+// RFC 7240), and defaults to data.RuntimeMins. A bad query parameter is recorded in the
+// validator, but like any preference one we don't understand in the header is just ignored
+func (app *application) readRuntimeFormat(w http.ResponseWriter, r *http.Request, v *validator.Validator) data.RuntimeFormat {
+	w.Header().Add("Vary", "Prefer")
+
+	format := data.RuntimeFormat(r.URL.Query().Get("runtime_format"))
+	if format != "" {
+		data.ValidateRuntimeFormat(v, format)
+		return format
+	}
+
+	for _, preference := range strings.Split(r.Header.Get("Prefer"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(preference), "=")
+		format := data.RuntimeFormat(strings.Trim(value, `"`))
+
+		if strings.EqualFold(name, "runtime-format") && slices.Contains(data.RuntimeFormats, format) {
+			w.Header().Set("Preference-Applied", "runtime-format="+string(format))
+			return format
+		}
+	}
+
+	return data.RuntimeMins
+}
+
+// negotiateLanguage returns the supported language with the highest quality value in an
+// Accept-Language header, eg "fr-CH, fr;q=0.9, en;q=0.8". Only the primary subtag is
+// compared, so fr-CH matches fr. Ties go to the language listed first, and a wildcard
+// means the default
+func negotiateLanguage(header string) string {
+	best, bestQ := data.DefaultLanguage, 0.0
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if primary == "*" {
+			primary = data.DefaultLanguage
+		}
+
+		if q > bestQ && slices.Contains(data.Languages, primary) {
+			best, bestQ = primary, q
+		}
+	}
+
+	return best
+}
+
+// queryOperators maps the operators that can appear between a field and its value in the
+// query string to filter operators. Longer operators come first so that >= isn't read as >
+var queryOperators = []struct {
+	token    string
+	operator data.FilterOperator
+}{
+	{">=", data.OpGte},
+	{"<=", data.OpLte},
+	{"!=", data.OpNe},
+	{">", data.OpGt},
+	{"<", data.OpLt},
+	{"=", data.OpEq},
+}
+
+// The readFilters() helper parses the filter conditions out of the raw query string. We need
+// the raw query because url.Values would split year>=1990 into the key "year>" and the value
+// "1990", and would read year<2000 as a key with no value. Two forms are supported:
+//
+//	year>=1990&year<2000&runtime<=120&genres!=horror
+//	year[gte]=1990&year[lt]=2000&genres[any]=drama,comedy&created_at[gte]=2024-01-01
+//
+// A plain key=value pair is only treated as a filter if the key is in the safelist, so the
+// other parameters (title, page, sort...) are left alone. For array fields = means
+// "contains all" and != means "contains none". An operator on a field that isn't in the
+// safelist, or a badly formed condition, is recorded in the validator.
+func (app *application) readFilters(rawQuery string, safelist map[string]data.FilterField, v *validator.Validator) []data.FilterCondition {
+	conditions := []data.FilterCondition{}
+
+	for _, part := range strings.Split(rawQuery, "&") {
+		part, err := url.QueryUnescape(part)
+		if err != nil || part == "" {
+			continue
+		}
+
+		i := strings.IndexAny(part, "<>!=[")
+		if i <= 0 {
+			continue
+		}
+
+		field, rest := part[:i], part[i:]
+		field = strings.TrimSpace(field)
+
+		var (
+			operator data.FilterOperator
+			value    string
+			plain    bool
+		)
+
+		if strings.HasPrefix(rest, "[") {
+			// bracket form, eg year[gte]=1990
+			name, after, found := strings.Cut(rest[1:], "]")
+			if !found || !strings.HasPrefix(after, "=") {
+				v.AddError(field, "must be in the form field[operator]=value")
+				continue
+			}
+			operator = data.FilterOperator(strings.ToLower(name))
+			value = after[1:]
+		} else {
+			for _, op := range queryOperators {
+				if strings.HasPrefix(rest, op.token) {
+					operator = op.operator
+					value = strings.TrimPrefix(rest, op.token)
+					break
+				}
+			}
+			if operator == "" {
+				v.AddError(field, "must be followed by an operator")
+				continue
+			}
+			plain = operator == data.OpEq
+		}
+
+		f, ok := safelist[field]
+		if !ok {
+			// plain parameters that aren't filters are handled elsewhere
+			if !plain {
+				v.AddError(field, "unknown filter field")
+			}
+			continue
+		}
+
+		// keep the old behaviour of ignoring an empty genres= parameter
+		if plain && value == "" {
+			continue
+		}
+
+		if f.Type == data.FilterStringArray {
+			switch operator {
+			case data.OpEq:
+				operator = data.OpAll
+			case data.OpNe:
+				operator = data.OpNone
+			}
+		}
+
+		conditions = append(conditions, data.FilterCondition{
+			Field:    field,
+			Operator: operator,
+			Value:    value,
+		})
+	}
+
+	return conditions
+}
+
 // background() helper runs the function in the background goroutine
 // handles all the errors and panic
 func (app *application) background(fn func()) {
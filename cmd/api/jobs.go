@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/mailer"
+	"greenlight.usman.com/internal/validator"
+)
+
+// The types of background job. Each one has a payload struct, which is stored as JSON in
+// the job, and a handler in jobHandlers
+const (
+	jobWelcomeEmail       = "welcome_email"
+	jobDeleteBlobs        = "delete_blobs"
+	jobEmailChangeConfirm = "email_change_confirm"
+	jobEmailChangeNotice  = "email_change_notice"
+)
+
+const (
+	// jobTimeout is how long a job can run for. The job is locked for a minute longer than
+	// that, so that a job is only picked up again if its worker has really gone away
+	jobTimeout = time.Minute
+	jobLease   = jobTimeout + time.Minute
+	// the first retry of a failed job is after jobBaseBackoff, and each retry after that waits
+	// twice as long as the one before, up to jobMaxBackoff
+	jobBaseBackoff = 5 * time.Second
+	jobMaxBackoff  = time.Hour
+)
+
+// errJobPermanent is wrapped by a job handler's error when the job can never succeed, the job
+// is moved straight to the dead-letter state instead of being retried
+var errJobPermanent = errors.New("permanent failure")
+
+// welcomeEmailJob sends the welcome email to a newly registered user. Only the ID is stored,
+// the user is read when the job runs, so the email goes to their current address
+type welcomeEmailJob struct {
+	UserID int64 `json:"user_id"`
+	// User is how the jobs queued before the payload was changed hold the ID
+	User *struct {
+		ID int64 `json:"id"`
+	} `json:"user,omitempty"`
+}
+
+// emailChangeConfirmJob sends the token which confirms an email change to the new address.
+// The token is made when the job runs, so that its plaintext is never stored in the job
+type emailChangeConfirmJob struct {
+	UserID   int64  `json:"user_id"`
+	NewEmail string `json:"new_email"`
+}
+
+// emailChangeNoticeJob tells the old address that the email is being changed, in case it
+// wasn't the owner of the account who asked for it, and gives it a token to cancel the change
+type emailChangeNoticeJob struct {
+	UserID   int64  `json:"user_id"`
+	Email    string `json:"email"`
+	Language string `json:"language"`
+}
+
+// deleteBlobsJob removes stored files which are no longer used, eg the old artwork
+type deleteBlobsJob struct {
+	Keys []string `json:"keys"`
+}
+
+// jobHandler runs a job with the JSON payload it was enqueued with
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+func (app *application) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobWelcomeEmail:       app.runWelcomeEmailJob,
+		jobDeleteBlobs:        app.runDeleteBlobsJob,
+		jobEmailChangeConfirm: app.runEmailChangeConfirmJob,
+		jobEmailChangeNotice:  app.runEmailChangeNoticeJob,
+	}
+}
+
+func (app *application) runWelcomeEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var job welcomeEmailJob
+
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return err
+	}
+
+	if job.UserID == 0 && job.User != nil {
+		job.UserID = job.User.ID
+	}
+
+	user, err := app.models.Users.Get(job.UserID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	// the account has been activated in the meantime, so the token isn't needed
+	if user.Activated {
+		return nil
+	}
+
+	// the activation token is made when the job runs, so that its plaintext is never stored
+	// in the job, and a retry replaces the token from the failed attempt
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(user.ID, activationTokenTTL, data.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	return app.sendEmail(ctx, user.Email, user.Language, "user_welcome.tmpl", map[string]any{
+		"activationToken": token.Plaintext,
+		"userID":          user.ID,
+	})
+}
+
+func (app *application) runEmailChangeConfirmJob(ctx context.Context, payload json.RawMessage) error {
+	var job emailChangeConfirmJob
+
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.Users.Get(job.UserID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	// the user has since confirmed, cancelled or asked for another address, so this change is
+	// no longer wanted
+	if !strings.EqualFold(user.PendingEmail, job.NewEmail) {
+		return nil
+	}
+
+	// only the newest token is valid, that includes the one from an earlier failed attempt
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		return err
+	}
+
+	// the token only confirms the change to this address, see UserModel.ConfirmEmailChange()
+	token, err := app.models.Tokens.NewForEmail(user.ID, emailChangeTokenTTL, data.ScopeEmailChange, user.PendingEmail)
+	if err != nil {
+		return err
+	}
+
+	return app.sendEmail(ctx, job.NewEmail, user.Language, "email_change_confirm.tmpl", map[string]any{
+		"token":  token.Plaintext,
+		"userID": user.ID,
+	})
+}
+
+func (app *application) runEmailChangeNoticeJob(ctx context.Context, payload json.RawMessage) error {
+	var job emailChangeNoticeJob
+
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.Users.Get(job.UserID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	templateData := map[string]any{
+		"userID": user.ID,
+	}
+
+	// while the change is still pending the old address gets a token to cancel it with. Like
+	// the confirmation token it is made when the job runs, and replaces any earlier one
+	if user.PendingEmail != "" {
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChangeCancel, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err := app.models.Tokens.NewForEmail(user.ID, emailChangeTokenTTL, data.ScopeEmailChangeCancel, user.PendingEmail)
+		if err != nil {
+			return err
+		}
+
+		templateData["cancelToken"] = token.Plaintext
+	}
+
+	// the notice goes to the address the user had when they asked for the change
+	return app.sendEmail(ctx, job.Email, job.Language, "email_change_notice.tmpl", templateData)
+}
+
+// sendEmail sends an email from a job. A suppressed recipient isn't an error, there is
+// nothing more to do for them, and a permanent failure isn't retried
+func (app *application) sendEmail(ctx context.Context, recipient, locale, templateFile string, data any) error {
+	err := app.mailer.Send(ctx, recipient, locale, templateFile, data)
+	switch {
+	case errors.Is(err, mailer.ErrSuppressed):
+		app.logger.Info("email not sent to suppressed address", "template", templateFile)
+		return nil
+	case errors.Is(err, mailer.ErrPermanent):
+		return fmt.Errorf("%w: %w", errJobPermanent, err)
+	default:
+		return err
+	}
+}
+
+func (app *application) runDeleteBlobsJob(ctx context.Context, payload json.RawMessage) error {
+	var job deleteBlobsJob
+
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range job.Keys {
+		err := app.blobs.Delete(ctx, key)
+		if err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// newJob returns a job for a model method to queue in the same transaction as the change it
+// follows on from, eg UserModel.InsertWithJob(), so the job can't be lost
+func (app *application) newJob(jobType string, payload any) data.NewJob {
+	return data.NewJob{Type: jobType, Payload: payload, MaxAttempts: app.config.jobs.maxAttempts}
+}
+
+// enqueue adds a job to the queue on its own. Callers log rather than fail the request if this
+// goes wrong, as the change the job follows on from has already been made
+func (app *application) enqueue(jobType string, payload any) error {
+	_, err := app.models.Jobs.Enqueue(jobType, payload, app.config.jobs.maxAttempts)
+	if err != nil {
+		return fmt.Errorf("enqueue %s job: %w", jobType, err)
+	}
+
+	return nil
+}
+
+// jobBackoff returns how long to wait before running a job again, after the given number of
+// attempts have failed
+func jobBackoff(attempts int32) time.Duration {
+	backoff := jobBaseBackoff
+	for i := int32(1); i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, jobMaxBackoff)
+}
+
+// runJobWorkers starts the pool of job workers. They stop taking new jobs when ctx is
+// cancelled, and as they are background tasks the graceful shutdown waits for the jobs they
+// are running to finish
+func (app *application) runJobWorkers(ctx context.Context) {
+	handlers := app.jobHandlers()
+
+	for range app.config.jobs.workers {
+		app.background(func() {
+			app.jobWorker(ctx, handlers)
+		})
+	}
+}
+
+// jobWorker runs jobs one at a time until ctx is cancelled. It only waits for the poll
+// interval when the queue is empty
+func (app *application) jobWorker(ctx context.Context, handlers map[string]jobHandler) {
+	for ctx.Err() == nil {
+		job, err := app.models.Jobs.Claim(jobLease)
+		if err != nil {
+			app.logger.Error("job claim", "error", err.Error())
+		}
+
+		if job != nil {
+			app.runJob(job, handlers)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(app.config.jobs.pollInterval):
+		}
+	}
+}
+
+// runJob runs a claimed job and records the result. A job that panics is treated like one
+// that returned an error
+func (app *application) runJob(job *data.Job, handlers map[string]jobHandler) {
+	handler, ok := handlers[job.Type]
+	if !ok {
+		// there is nothing to retry, no worker knows how to run it
+		err := app.models.Jobs.Bury(job.ID, "unknown job type "+job.Type)
+		if err != nil {
+			app.logger.Error("job", "id", job.ID, "error", err.Error())
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+
+		return handler(ctx, job.Payload)
+	}()
+
+	switch {
+	case err == nil:
+		err = app.models.Jobs.Succeed(job.ID)
+	case job.Attempts >= job.MaxAttempts || errors.Is(err, errJobPermanent):
+		app.logger.Warn("job dead", "id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err.Error())
+		err = app.models.Jobs.Bury(job.ID, err.Error())
+	default:
+		app.logger.Info("job failed", "id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err.Error())
+		err = app.models.Jobs.Retry(job.ID, err.Error(), jobBackoff(job.Attempts))
+	}
+
+	if err != nil {
+		app.logger.Error("job", "id", job.ID, "error", err.Error())
+	}
+}
+
+// listJobsHandler handles GET /v1/jobs. The dead-letter queue is GET /v1/jobs?status=dead
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	filters := data.Filters{
+		Page:           app.readInt(qs, "page", 1, v),
+		PageSize:       app.readInt(qs, "page_size", 20, v),
+		Sort:           app.readString(qs, "sort", "-id"),
+		SortSafelist:   data.JobFields.SortSafelist(),
+		FilterSafelist: data.JobFields.FilterSafelist(),
+	}
+	filters.Conditions = app.readFilters(r.URL.RawQuery, filters.FilterSafelist, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	jobs, metadata, err := app.models.Jobs.GetAll(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"jobs": jobs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showJobHandler handles GET /v1/jobs/:id
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// retryJobHandler handles POST /v1/jobs/:id/retry, which puts a dead job back in the queue.
+// Only dead jobs can be retried, anything else gets a 409 Conflict
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Requeue(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrJobNotDead):
+			app.errorResponse(w, r, http.StatusConflict, "only dead jobs can be retried")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelop{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
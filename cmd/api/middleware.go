@@ -1,13 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/validator"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -52,6 +56,28 @@ func (app *application) rateLimitv1(next http.Handler) http.Handler {
 	})
 }
 
+// limiterUnits is the number of tokens a normal request costs. The per-client limiters are
+// scaled up by this factor (so the configured rps and burst still mean whole requests), which
+// lets cheaper endpoints cost a fraction of a request
+const limiterUnits = 4
+
+// requestCost returns how many limiter tokens a request costs. Suggestions are fired on every
+// keystroke in the UI but are cheap to serve, so they only cost a quarter of a request
+func requestCost(r *http.Request) int {
+	if r.URL.Path == "/v1/suggest" {
+		return 1
+	}
+
+	return limiterUnits
+}
+
+// isHealthcheck reports whether the request is for one of the health check endpoints. They
+// are probed by the orchestrator and load balancers, so they are not rate limited, a busy
+// client sharing their IP address mustn't make the instance look unready
+func isHealthcheck(r *http.Request) bool {
+	return r.URL.Path == "/v1/healthcheck" || strings.HasPrefix(r.URL.Path, "/v1/healthcheck/")
+}
+
 func (app *application) rateLimit(next http.Handler) http.Handler {
 
 	type client struct {
@@ -88,6 +114,15 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	}()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// load the current runtime settings, these can change on a config reload
+		rc := app.runtime.Load()
+
+		// if the limiter has been disabled, or this is a health check, there is nothing to do
+		if !rc.limiter.enabled || isHealthcheck(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// extract the IP address from the request
 		ip, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
@@ -95,6 +130,10 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			return
 		}
 
+		// the limits are in limiter units rather than requests, see requestCost
+		limit := rate.Limit(rc.limiter.rps * limiterUnits)
+		burst := rc.limiter.burst * limiterUnits
+
 		// lock the mutex to prevent the code from being executed concurrently
 		mu.Lock()
 
@@ -106,19 +145,25 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			// if it does not exist
 
 			clients[ip] = &client{
-				limiter: rate.NewLimiter(
-					rate.Limit(app.config.limiter.rps),
-					app.config.limiter.burst,
-				),
+				limiter: rate.NewLimiter(limit, burst),
 			}
 		}
 
+		// if the limits were changed by a config reload, update the existing limiter in place
+		// rather than replacing it, so that the client keeps the tokens it has already used
+		if clients[ip].limiter.Limit() != limit {
+			clients[ip].limiter.SetLimit(limit)
+		}
+		if clients[ip].limiter.Burst() != burst {
+			clients[ip].limiter.SetBurst(burst)
+		}
+
 		// update the lastseen time for the client
 		clients[ip].lastSeen = time.Now()
 
-		// Call the allow method on the rate limiter for the current
-		// IP address and see if the request is allowed or not
-		if !clients[ip].limiter.Allow() {
+		// Call the AllowN method on the rate limiter for the current IP address, taking
+		// as many tokens as the request costs, and see if the request is allowed or not
+		if !clients[ip].limiter.AllowN(time.Now(), requestCost(r)) {
 			mu.Unlock()
 			app.rateLimitExceededResponse(w, r)
 			return
@@ -130,3 +175,180 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 	})
 }
+
+// enableCORS adds the Access-Control-Allow-Origin header for requests coming from one of the
+// trusted origins, and responds to preflight requests. The trusted origins are read from the
+// runtime config on every request, so they can be changed with a config reload
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the response will be different depending on the origin, so caches must take it into account
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+
+		if origin != "" {
+			for _, trusted := range app.runtime.Load().cors.trustedOrigins {
+				if origin != trusted {
+					continue
+				}
+
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+
+				// a preflight request is an OPTIONS request with an Access-Control-Request-Method header
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+
+				break
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeTimeout returns the handler time limit for a route, the per-route override if one has
+// been configured and the default handler timeout otherwise
+func (app *application) routeTimeout(method, path string) time.Duration {
+	if d, ok := app.config.server.routeTimeouts[method+" "+path]; ok {
+		return d
+	}
+
+	return app.config.server.handlerTimeout
+}
+
+// timeout limits how long the handler can run for. It works like http.TimeoutHandler (and
+// uses it under the hood) but responds with our JSON error envelope. Because the override can
+// be longer than the server's read and write timeouts, the connection deadlines for this
+// request are pushed out to match, otherwise the server would cut the connection first.
+func (app *application) timeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+
+	th := http.TimeoutHandler(next, d, timeoutMessage)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// not every ResponseWriter supports deadlines, if not we just keep the server ones
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(d + time.Second)
+		_ = rc.SetReadDeadline(deadline)
+		_ = rc.SetWriteDeadline(deadline)
+
+		// TimeoutHandler only writes its message on a timeout, so this header is only seen
+		// then. A successful response replaces it with the handler's own headers
+		w.Header().Set("Content-Type", "application/json")
+
+		th.ServeHTTP(w, r)
+	})
+}
+
+// authenticate adds the user to the request context. A request without an Authorization
+// header is anonymous, but one with a malformed, unknown or expired token is rejected
+// rather than quietly treated as anonymous
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the response depends on the Authorization header, so tell any caches
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// we expect the header to be in the format "Bearer <token>"
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		token := headerParts[1]
+
+		v := validator.New()
+
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthenticatedUser wraps the handlers that need a signed in user, anonymous
+// requests get a 401
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireActivatedUser wraps the handlers that need a signed in user who has activated their
+// account with the token from the welcome email. Anonymous requests get a 401 and users who
+// haven't activated a 403
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requirePermission wraps the handlers that need a signed in user with the permission code,
+// eg genres:write. Anonymous requests get a 401 and users without the permission a 403
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"greenlight.usman.com/internal/data"
 	"greenlight.usman.com/internal/validator"
@@ -21,10 +22,17 @@ import (
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Declare an annonymous struct to hold the information we expect in HTTP body
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title               string            `json:"title"`
+		Synopsis            string            `json:"synopsis"`
+		Year                int32             `json:"year"`
+		Runtime             data.Runtime      `json:"runtime"`
+		Genres              []string          `json:"genres"`
+		ContentRatingSystem string            `json:"content_rating_system"`
+		ContentRating       string            `json:"content_rating"`
+		ReleaseDates        data.ReleaseDates `json:"release_dates"`
+		OriginalLanguage    string            `json:"original_language"`
+		ImdbID              string            `json:"imdb_id"`
+		TmdbID              int64             `json:"tmdb_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -37,26 +45,55 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// we copy over the input struct into a movie struct and perform the valdiation
 	// checks on the movie struct
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:               input.Title,
+		Synopsis:            input.Synopsis,
+		Year:                input.Year,
+		Runtime:             input.Runtime,
+		Genres:              input.Genres,
+		ContentRatingSystem: input.ContentRatingSystem,
+		ContentRating:       input.ContentRating,
+		ReleaseDates:        input.ReleaseDates,
+		OriginalLanguage:    input.OriginalLanguage,
+		ImdbID:              input.ImdbID,
+		TmdbID:              input.TmdbID,
 	}
 
+	// genres are stored as the slugs from the genre taxonomy, so "Sci-Fi" or an alias like
+	// "science fiction" are turned into sci-fi before the movie is validated
+	genres, err := app.models.Genres.Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	movie.Genres = genres.Canonicalise(movie.Genres)
+
 	// Initialize a new valdiator instance
 	v := validator.New()
 
+	// the runtime is accepted in several forms, and written back in the one asked for
+	movie.FormatRuntime(app.readRuntimeFormat(w, r, v))
+
 	// we can use the Valid() method to see if any of the checks failed. If they did,
 	// we can then use the failedValidationResponse helper to send a response to the client
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if data.ValidateMovie(v, movie, genres); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the Insert() method on our movies Model to create a record in the DB and update movie struct
+	// The external IDs are unique, so another movie may already have them
 	err = app.models.Movies.Insert(movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateImdbID):
+			v.AddError("imdb_id", "a movie with this IMDb ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateTmdbID):
+			v.AddError("tmdb_id", "a movie with this TMDB ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -82,10 +119,27 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// we call the Get() method to fetch the data for a specific movie
+	// fields=id,title returns only those fields, include= embeds related resources
+	qs := r.URL.Query()
+	fields := app.readCSV(qs, "fields", []string{})
+	includes := app.readCSV(qs, "include", []string{})
+
+	v := validator.New()
+
+	// the title is translated into the language asked for with lang= or Accept-Language, and
+	// the runtime written in the format from runtime_format= or the Prefer header
+	lang := app.readLanguage(w, r, v)
+	runtimeFormat := app.readRuntimeFormat(w, r, v)
+
+	if data.ValidateFieldset(v, fields, data.MovieSelectSafelist, includes, data.MovieIncludeSafelist); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// we call the GetFields() method to fetch the data for a specific movie
 	// we also need to use the errors.Is() to check for ErrRecordNotFound
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.GetFields(id, lang, fields)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -97,7 +151,29 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, nil)
+	movie.FormatRuntime(runtimeFormat)
+
+	err = app.includeArtwork(movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// embed the related resources that were asked for
+	if slices.Contains(includes, "credits") {
+		err = app.includeCredits(movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	headers := make(http.Header)
+	if language := contentLanguage(movie); language != "" {
+		headers.Set("Content-Language", language)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -128,11 +204,19 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Declare an input struct to hold the expected data from the client
 	// We use pointers for the Title, Year and Runtime fields.
 	// Reason - so that we can skip through the fields that are not passed by the user
+	// An empty value clears the optional fields, eg "imdb_id": "" or "release_dates": {}
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  *[]string     `json:"genres"`
+		Title               *string            `json:"title"`
+		Synopsis            *string            `json:"synopsis"`
+		Year                *int32             `json:"year"`
+		Runtime             *data.Runtime      `json:"runtime"`
+		Genres              *[]string          `json:"genres"`
+		ContentRatingSystem *string            `json:"content_rating_system"`
+		ContentRating       *string            `json:"content_rating"`
+		ReleaseDates        *data.ReleaseDates `json:"release_dates"`
+		OriginalLanguage    *string            `json:"original_language"`
+		ImdbID              *string            `json:"imdb_id"`
+		TmdbID              *int64             `json:"tmdb_id"`
 	}
 
 	// read the request body struct into the input struct
@@ -163,9 +247,46 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		movie.Genres = *input.Genres // Note that we don't need to deference a slice
 	}
 
+	if input.Synopsis != nil {
+		movie.Synopsis = *input.Synopsis
+	}
+
+	if input.ContentRatingSystem != nil {
+		movie.ContentRatingSystem = *input.ContentRatingSystem
+	}
+
+	if input.ContentRating != nil {
+		movie.ContentRating = *input.ContentRating
+	}
+
+	if input.ReleaseDates != nil {
+		movie.ReleaseDates = *input.ReleaseDates
+	}
+
+	if input.OriginalLanguage != nil {
+		movie.OriginalLanguage = *input.OriginalLanguage
+	}
+
+	if input.ImdbID != nil {
+		movie.ImdbID = *input.ImdbID
+	}
+
+	if input.TmdbID != nil {
+		movie.TmdbID = *input.TmdbID
+	}
+
+	genres, err := app.models.Genres.Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	movie.Genres = genres.Canonicalise(movie.Genres)
+
 	v := validator.New()
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	movie.FormatRuntime(app.readRuntimeFormat(w, r, v))
+
+	if data.ValidateMovie(v, movie, genres); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -178,6 +299,12 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateImdbID):
+			v.AddError("imdb_id", "a movie with this IMDb ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateTmdbID):
+			v.AddError("tmdb_id", "a movie with this TMDB ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -199,6 +326,13 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// the artwork rows go with the movie, so read them first to know which files to delete
+	artwork, err := app.models.Artwork.GetForMovies([]int64{id})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// delete the movie from the database
 	// sending a 404 response if no matching record found
 	err = app.models.Movies.Delete(id)
@@ -212,6 +346,8 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.deleteBlobs(keysOf(artwork[id]))
+
 	// return a 200 OK status code, along with a success message
 	err = app.writeJSON(w, http.StatusOK, envelop{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -223,8 +359,12 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	// To keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string
 	var input struct {
-		Title  string
-		Genres []string
+		Title         string
+		Language      string
+		RuntimeFormat data.RuntimeFormat
+		SearchMode    data.SearchMode
+		Facets        []string
+		Include       []string
 		data.Filters
 	}
 
@@ -233,33 +373,117 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	// Call the r.URL.Query function to the url.Values map containing the query string data
 	qs := r.URL.Query()
 
-	// Using the helpers to extract the title, genres query string values
+	// Using the helpers to extract the title query string value
 	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+
+	// The field filters, eg genres=drama,comedy (all of), genres[any]=drama,comedy, year>=1990,
+	// runtime<=120, created_at[gte]=2024-01-01, person=42, content_rating=PG-13, released_in=GB
+	// or imdb_id=tt0111161. See readFilters() for the grammar
+	input.Filters.FilterSafelist = data.MovieFilterSafelist
+	input.Filters.Conditions = app.readFilters(r.URL.RawQuery, input.Filters.FilterSafelist, v)
+
+	// the titles are translated into the language asked for with lang= or Accept-Language,
+	// and the title search looks at the titles in that language as well as the originals
+	input.Language = app.readLanguage(w, r, v)
+
+	// runtime_format picks how the runtimes are written: mins, hours-minutes, iso8601 or integer
+	input.RuntimeFormat = app.readRuntimeFormat(w, r, v)
+
+	// search_mode picks how the title is matched: fulltext, prefix, fuzzy or auto
+	input.SearchMode = data.SearchMode(app.readString(qs, "search_mode", string(data.SearchFullText)))
+
+	// facets is opt-in, eg facets=genres,year adds the bucket counts to the response
+	input.Facets = app.readCSV(qs, "facets", []string{})
+
+	// sparse fieldsets, eg fields=id,title, and related resources to embed with include=
+	input.Filters.Fields = app.readCSV(qs, "fields", []string{})
+	input.Include = app.readCSV(qs, "include", []string{})
 
 	// Get the page and page_size query string values as integers, Notice that we set the default value of
 	// the page to 1 and default of page_size to 20, and that we pass the validator isntance as the final argument here
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
-	// Extract the sort query string value, falling back to id if the value is not provided
+	// Extract the sort query string value, falling back to id if the value is not provided.
+	// Several keys can be given, eg sort=-year,title
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	// we are going to set the sorted safelist value
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-runtime"}
+	// the safelist is generated from the movie field registry, so every sortable field
+	// is allowed in both directions
+	input.Filters.SortSafelist = data.MovieSortSafelist
+
+	// watched=true|false narrows the list to the movies the authenticated user has (or
+	// hasn't) watched, so it only makes sense with a token
+	watched := app.readBool(qs, "watched", v)
+	if watched != nil {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		input.Filters.AddWatchedFilter(user.ID, *watched)
+	}
+
+	data.ValidateSearch(v, input.Title, input.SearchMode, input.Filters)
+	data.ValidateFacets(v, input.Facets)
+	data.ValidateFieldset(v, input.Filters.Fields, data.MovieSelectSafelist, input.Include, data.MovieIncludeSafelist)
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// genres filters can use any spelling or alias of a genre, the movies store the slugs
+	err := app.canonicaliseGenreFilters(&input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// use the GetAll function in movies to get all the movies array
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Language, input.SearchMode, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, movie := range movies {
+		movie.FormatRuntime(input.RuntimeFormat)
+	}
+
+	err = app.includeArtwork(movies...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelop{"movies": movies, "metadata": metadata}, nil)
+	// embed the related resources that were asked for
+	if slices.Contains(input.Include, "credits") {
+		err = app.includeCredits(movies...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelop{"movies": movies, "metadata": metadata}
+
+	// the facets are computed over the same title search and filters as the movies, except
+	// that each facet leaves out the filters on its own field
+	if len(input.Facets) > 0 {
+		facets, err := app.models.Movies.Facets(input.Title, input.Language, input.SearchMode, input.Filters, input.Facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["facets"] = facets
+	}
+
+	headers := make(http.Header)
+	if language := contentLanguage(movies...); language != "" {
+		headers.Set("Content-Language", language)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// reloadableSettings are the settings which are safe to change while the server is running.
+// Anything else (the port, the DSN, the SMTP settings...) needs a restart to take effect.
+var reloadableSettings = map[string]bool{
+	"limiter-rps":          true,
+	"limiter-burst":        true,
+	"limiter-enabled":      true,
+	"cors-trusted-origins": true,
+	"log-level":            true,
+}
+
+// runtimeConfig holds the settings that can be swapped on a SIGHUP. The handlers and
+// middleware read it through app.runtime.Load(), so a reload never needs a lock and a
+// request always sees one consistent set of values.
+type runtimeConfig struct {
+	limiter struct {
+		rps     float64
+		burst   int
+		enabled bool
+	}
+	cors struct {
+		trustedOrigins []string
+	}
+}
+
+// applyRuntimeConfig copies the runtime settings out of cfg and atomically swaps them in
+func (app *application) applyRuntimeConfig(cfg config) {
+	rc := &runtimeConfig{}
+	rc.limiter.rps = cfg.limiter.rps
+	rc.limiter.burst = cfg.limiter.burst
+	rc.limiter.enabled = cfg.limiter.enabled
+	rc.cors.trustedOrigins = cfg.cors.trustedOrigins
+
+	// the level has already been validated by loadConfig, so this can't fail
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.logLevel))
+	app.logLevel.Set(level)
+
+	app.runtime.Store(rc)
+}
+
+// watchReload listens for SIGHUP and re-reads the config from the same sources as at startup.
+// If the new config is invalid it is rejected and the running settings are left untouched.
+// The initial settings are passed in so that we can log what changed on each reload.
+func (app *application) watchReload(args []string, current map[string]string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		app.logger.Info("reloading config", "signal", "hangup")
+
+		cfg, fs, err := loadConfig(args)
+		if err != nil {
+			app.logger.Error("config reload rejected", "error", err.Error())
+			continue
+		}
+
+		next := configSettings(fs)
+
+		names := make([]string, 0, len(next))
+		for name := range next {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		changed := 0
+		for _, name := range names {
+			if current[name] == next[name] {
+				continue
+			}
+
+			if reloadableSettings[name] {
+				app.logger.Info("config changed", "setting", name, "old", current[name], "new", next[name])
+				changed++
+			} else {
+				app.logger.Warn("config change requires a restart", "setting", name, "old", current[name], "new", next[name])
+				// keep the old value so that we warn again on the next reload
+				next[name] = current[name]
+			}
+		}
+
+		app.applyRuntimeConfig(cfg)
+		current = next
+
+		app.logger.Info("config reloaded", "changed", changed)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.usman.com/internal/storage"
 )
 
 func (app *application) routes() http.Handler {
@@ -15,23 +16,119 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowed)
 
+	// handle registers a handler on the router, wrapped with the time limit for the route
+	// (see the server-handler-timeout and server-route-timeouts settings)
+	handle := func(method, path string, handler http.HandlerFunc) {
+		router.Handler(method, path, app.timeout(app.routeTimeout(method, path), handler))
+	}
+
 	// Register the relevant mthods, URL patterns and handler function for our endpoints
-	// using the HandlerFunc() method. Note that http.MethodGet and http.MethodPost are constants
+	// using the handle() helper. Note that http.MethodGet and http.MethodPost are constants
 	// whcih equate to the strings GET and POST respectively
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMovieHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
+	handle(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck/live", app.livenessHandler)
+	handle(http.MethodGet, "/v1/healthcheck/ready", app.readinessHandler)
+	handle(http.MethodGet, "/v1/movies", app.listMovieHandler)
+	handle(http.MethodPost, "/v1/movies", app.createMovieHandler)
+	handle(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
 
 	// Adding a route for the PATCH and DELETE movie method
 	// PATCH - is used for partial updates
 	// PUT - is used for completely replacing the record
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+	handle(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
+	handle(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+
+	// Cast and crew. The credits are managed under the movie they belong to. Anyone can read
+	// them, changing them (or the people) needs the movies:write permission
+	handle(http.MethodGet, "/v1/movies/:id/credits", app.listMovieCreditsHandler)
+	handle(http.MethodPost, "/v1/movies/:id/credits", app.requirePermission("movies:write", app.createMovieCreditHandler))
+	handle(http.MethodPatch, "/v1/movies/:id/credits/:credit_id", app.requirePermission("movies:write", app.updateMovieCreditHandler))
+	handle(http.MethodDelete, "/v1/movies/:id/credits/:credit_id", app.requirePermission("movies:write", app.deleteMovieCreditHandler))
+
+	// The people the credits refer to
+	handle(http.MethodGet, "/v1/people", app.listPeopleHandler)
+	handle(http.MethodPost, "/v1/people", app.requirePermission("movies:write", app.createPersonHandler))
+	handle(http.MethodGet, "/v1/people/:id", app.showPersonHandler)
+	handle(http.MethodPatch, "/v1/people/:id", app.requirePermission("movies:write", app.updatePersonHandler))
+	handle(http.MethodDelete, "/v1/people/:id", app.requirePermission("movies:write", app.deletePersonHandler))
+
+	// Translated titles and synopses, one for each of the supported languages. Changing them
+	// needs the movies:write permission
+	handle(http.MethodGet, "/v1/movies/:id/translations", app.listMovieTranslationsHandler)
+	handle(http.MethodPut, "/v1/movies/:id/translations/:lang", app.requirePermission("movies:write", app.putMovieTranslationHandler))
+	handle(http.MethodDelete, "/v1/movies/:id/translations/:lang", app.requirePermission("movies:write", app.deleteMovieTranslationHandler))
+
+	// Artwork uploads, as multipart/form-data or the raw image. Uploading or deleting it needs
+	// the movies:write permission
+	handle(http.MethodPut, "/v1/movies/:id/poster", app.requirePermission("movies:write", app.uploadArtworkHandler("poster")))
+	handle(http.MethodDelete, "/v1/movies/:id/poster", app.requirePermission("movies:write", app.deleteArtworkHandler("poster")))
+	handle(http.MethodPut, "/v1/movies/:id/backdrop", app.requirePermission("movies:write", app.uploadArtworkHandler("backdrop")))
+	handle(http.MethodDelete, "/v1/movies/:id/backdrop", app.requirePermission("movies:write", app.deleteArtworkHandler("backdrop")))
+
+	// With the local storage backend the uploaded files are served by the API itself
+	if local, ok := app.blobs.(*storage.LocalStore); ok {
+		router.Handler(http.MethodGet, "/v1/artwork/*filepath", http.StripPrefix("/v1/artwork", local.Handler()))
+	}
+
+	// Reviews. Anyone can read them, but a user has to have activated their account to write
+	// their own review, which lives at /review under the movie
+	handle(http.MethodGet, "/v1/movies/:id/reviews", app.listMovieReviewsHandler)
+	handle(http.MethodPost, "/v1/movies/:id/review", app.requireActivatedUser(app.createReviewHandler))
+	handle(http.MethodPatch, "/v1/movies/:id/review", app.requireActivatedUser(app.updateReviewHandler))
+	handle(http.MethodDelete, "/v1/movies/:id/review", app.requireActivatedUser(app.deleteReviewHandler))
+
+	// The genre taxonomy. Anyone can read it, changing it needs the genres:write permission
+	handle(http.MethodGet, "/v1/genres", app.listGenresHandler)
+	handle(http.MethodPost, "/v1/genres", app.requirePermission("genres:write", app.createGenreHandler))
+	handle(http.MethodGet, "/v1/genres/:slug", app.showGenreHandler)
+	handle(http.MethodPatch, "/v1/genres/:slug", app.requirePermission("genres:write", app.updateGenreHandler))
+	handle(http.MethodDelete, "/v1/genres/:slug", app.requirePermission("genres:write", app.deleteGenreHandler))
+
+	// Webhook subscriptions and their delivery logs, all behind the webhooks:manage permission
+	handle(http.MethodGet, "/v1/webhooks", app.requirePermission("webhooks:manage", app.listWebhooksHandler))
+	handle(http.MethodPost, "/v1/webhooks", app.requirePermission("webhooks:manage", app.createWebhookHandler))
+	handle(http.MethodGet, "/v1/webhooks/:id", app.requirePermission("webhooks:manage", app.showWebhookHandler))
+	handle(http.MethodPatch, "/v1/webhooks/:id", app.requirePermission("webhooks:manage", app.updateWebhookHandler))
+	handle(http.MethodDelete, "/v1/webhooks/:id", app.requirePermission("webhooks:manage", app.deleteWebhookHandler))
+	handle(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission("webhooks:manage", app.listWebhookDeliveriesHandler))
+	handle(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/replay", app.requirePermission("webhooks:manage", app.replayWebhookDeliveryHandler))
+
+	// The background job queue. Failed jobs end up dead and can be put back in the queue
+	handle(http.MethodGet, "/v1/jobs", app.requirePermission("jobs:manage", app.listJobsHandler))
+	handle(http.MethodGet, "/v1/jobs/:id", app.requirePermission("jobs:manage", app.showJobHandler))
+	handle(http.MethodPost, "/v1/jobs/:id/retry", app.requirePermission("jobs:manage", app.retryJobHandler))
+
+	// Bounce and complaint notifications from the mail provider, authenticated with a shared secret
+	handle(http.MethodPost, "/v1/email/bounces", app.emailBounceHandler)
+
+	// The suppression list can also be changed by hand, with the emails:manage permission
+	handle(http.MethodPost, "/v1/email/suppressions", app.requirePermission("emails:manage", app.createSuppressionHandler))
+	handle(http.MethodDelete, "/v1/email/suppressions/:email", app.requirePermission("emails:manage", app.deleteSuppressionHandler))
+
+	// Type-ahead suggestions for titles and genres
+	handle(http.MethodGet, "/v1/suggest", app.suggestHandler)
 
 	// Add the route for the POST /v1/users endpoint
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	handle(http.MethodPost, "/v1/users", app.registerUserHandler)
+	handle(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	handle(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.updateCurrentUserHandler))
+	handle(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	handle(http.MethodDelete, "/v1/users/email", app.cancelEmailChangeHandler)
+	handle(http.MethodGet, "/v1/users/me/reviews", app.requireAuthenticatedUser(app.listUserReviewsHandler))
+
+	// The authenticated user's watchlist, kept in their own order, and their watch history
+	handle(http.MethodGet, "/v1/users/me/watchlist", app.requireAuthenticatedUser(app.listWatchlistHandler))
+	handle(http.MethodPost, "/v1/users/me/watchlist", app.requireAuthenticatedUser(app.addToWatchlistHandler))
+	handle(http.MethodPatch, "/v1/users/me/watchlist/:movie_id", app.requireAuthenticatedUser(app.moveWatchlistEntryHandler))
+	handle(http.MethodDelete, "/v1/users/me/watchlist/:movie_id", app.requireAuthenticatedUser(app.removeFromWatchlistHandler))
+	handle(http.MethodGet, "/v1/users/me/history", app.requireAuthenticatedUser(app.listHistoryHandler))
+	handle(http.MethodPost, "/v1/users/me/history", app.requireAuthenticatedUser(app.addToHistoryHandler))
+	handle(http.MethodDelete, "/v1/users/me/history/:movie_id", app.requireAuthenticatedUser(app.removeFromHistoryHandler))
+
+	// Exchange an email address and password for an authentication token
+	handle(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
-	// We are going to wrap the router function with the recoverPanic middleware
-	return app.recoverPanic(app.rateLimit(router))
+	// We are going to wrap the router function with the recoverPanic middleware. The user
+	// is authenticated after the rate limit, so bad tokens can't be used to hammer the DB
+	return app.recoverPanic(app.hsts(app.enableCORS(app.rateLimit(app.authenticate(router)))))
 }
@@ -10,22 +10,79 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func (app *application) serve() error {
-	// declaring an http server using the same settings as in out main() function
+	handler := app.routes()
+
+	// With h2c enabled, clients can speak HTTP/2 over a plain TCP connection (either with
+	// prior knowledge or the Upgrade header). HTTP/1.1 requests are passed through as usual
+	if app.config.server.h2c {
+		handler = h2c.NewHandler(handler, &http2.Server{
+			IdleTimeout: app.config.server.idleTimeout,
+		})
+	}
+
+	// declaring an http server using the timeouts from the config
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		Addr:              fmt.Sprintf(":%d", app.config.port),
+		Handler:           handler,
+		IdleTimeout:       app.config.server.idleTimeout,
+		ReadTimeout:       app.config.server.readTimeout,
+		ReadHeaderTimeout: app.config.server.readHeaderTimeout,
+		WriteTimeout:      app.config.server.writeTimeout,
+		MaxHeaderBytes:    app.config.server.maxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+	}
+
+	// If a certificate has been configured we serve HTTPS. The certificate is loaded through
+	// the certReloader so that it can be rotated on disk without a restart
+	var (
+		certs       *certReloader
+		redirectSrv *http.Server
+		certDone    = make(chan struct{})
+	)
+
+	if app.config.tls.certFile != "" {
+		var err error
+		certs, err = newCertReloader(app.config.tls.certFile, app.config.tls.keyFile)
+		if err != nil {
+			return err
+		}
+
+		srv.TLSConfig = tlsConfig(certs)
+		go app.watchCertificate(certs, certDone)
+
+		if app.config.tls.redirectPort != 0 {
+			redirectSrv = &http.Server{
+				Addr:              fmt.Sprintf(":%d", app.config.tls.redirectPort),
+				Handler:           app.redirectToHTTPS(),
+				IdleTimeout:       app.config.server.idleTimeout,
+				ReadTimeout:       app.config.server.readTimeout,
+				ReadHeaderTimeout: app.config.server.readHeaderTimeout,
+				WriteTimeout:      app.config.server.writeTimeout,
+				MaxHeaderBytes:    app.config.server.maxHeaderBytes,
+				ErrorLog:          slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+			}
+		}
 	}
 
 	// create a shutdown channel to receive any errors returned by the graceful Shutdown function
 	shutdownError := make(chan error)
 
+	// Start the job workers and the webhook dispatcher. They run as background tasks, so the
+	// shutdown below waits for them to finish what they are doing once they have been told to stop
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	app.runJobWorkers(workersCtx)
+	app.background(func() {
+		app.dispatchWebhooks(workersCtx)
+	})
+
 	// Start a background goroutine to listen for OS signals for graceful shutdowns
 	go func() {
 		// create a new channel which carries os.Signal values
@@ -43,10 +100,27 @@ func (app *application) serve() error {
 		// the String() method on the signal to get the signal name and include it in the entry
 		app.logger.Info("shutting down server", "signal", s.String())
 
-		// create a context with a 30 second timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// mark the server as draining so the readiness check starts returning 503, then give
+		// the load balancers a moment to take us out of rotation before we stop accepting requests
+		app.draining.Store(true)
+		if app.config.drainDelay > 0 {
+			app.logger.Info("draining", "delay", app.config.drainDelay.String())
+			time.Sleep(app.config.drainDelay)
+		}
+
+		// create a context with the shutdown timeout from the config (30 seconds by default)
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.server.shutdownTimeout)
 		defer cancel()
 
+		// stop the redirect server first, it has nothing in flight worth waiting for
+		if redirectSrv != nil {
+			err := redirectSrv.Shutdown(ctx)
+			if err != nil {
+				app.logger.Error("redirect server shutdown", "error", err.Error())
+			}
+		}
+		close(certDone)
+
 		err := srv.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
@@ -54,6 +128,7 @@ func (app *application) serve() error {
 
 		// log an error message saying that we are waiting for background goroutines to complete
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
+		stopWorkers()
 		// Call the Wait() to block until our WaitGroup counter is zero
 		app.wg.Wait()
 		// call shutdown on the server passing the context
@@ -65,12 +140,29 @@ func (app *application) serve() error {
 
 	}()
 
-	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
+	if redirectSrv != nil {
+		go func() {
+			app.logger.Info("starting redirect server", "addr", redirectSrv.Addr)
+
+			err := redirectSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error("redirect server", "error", err.Error())
+			}
+		}()
+	}
+
+	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env, "tls", certs != nil, "h2c", app.config.server.h2c)
 
 	// calling Shutdown() on the server will cause ListenAndServe() to immediately return an
 	// http.ErrServerClosed error. So if we see this error, it is actually a good thing and an
 	// indication that the graceful shutdown has started.
-	err := srv.ListenAndServe()
+	// With TLS the certificate comes from srv.TLSConfig.GetCertificate, so we pass empty file names
+	var err error
+	if certs != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/validator"
+)
+
+// suggestHandler handles GET /v1/suggest?q=...&field=title|genre&limit=N for type-ahead.
+// It only returns the matching values, not whole movies, so it is much cheaper than
+// listMovieHandler and has a lower rate-limit cost (see requestCost in middleware.go)
+func (app *application) suggestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Q     string
+		Field string
+		Limit int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Q = strings.TrimSpace(app.readString(qs, "q", ""))
+	input.Field = app.readString(qs, "field", "title")
+	input.Limit = app.readInt(qs, "limit", 10, v)
+
+	if data.ValidateSuggest(v, input.Q, input.Field, input.Limit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Movies.Suggest(input.Q, input.Field, input.Limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"suggestions": suggestions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
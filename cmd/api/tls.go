@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often we check the certificate files for changes
+const certReloadInterval = 10 * time.Second
+
+// certReloader holds the current TLS certificate and reloads it from disk whenever the
+// cert or key file changes, eg after cert-manager has rotated them. It plugs into the
+// tls.Config through GetCertificate, so new handshakes pick up the new certificate
+// without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newCertReloader loads the certificate once, so that a bad cert or key fails at startup
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	_, err := cr.reloadIfChanged()
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// reloadIfChanged re-reads the key pair if either file has a different modification time
+// from the last successful load. It reports whether the certificate was reloaded.
+func (cr *certReloader) reloadIfChanged() (bool, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && certInfo.ModTime().Equal(cr.certMod) && keyInfo.ModTime().Equal(cr.keyMod)
+	cr.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("loading TLS key pair: %w", err)
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.certMod = certInfo.ModTime()
+	cr.keyMod = keyInfo.ModTime()
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+// watchCertificate polls the certificate files until done is closed. If a reload fails (eg the cert
+// has been written but the key hasn't yet) we keep serving the old certificate and try
+// again on the next tick.
+func (app *application) watchCertificate(cr *certReloader, done <-chan struct{}) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reloaded, err := cr.reloadIfChanged()
+			if err != nil {
+				app.logger.Error("TLS certificate reload failed", "error", err.Error())
+				continue
+			}
+			if reloaded {
+				app.logger.Info("TLS certificate reloaded", "cert", cr.certFile)
+			}
+		}
+	}
+}
+
+// GetCertificate satisfies the tls.Config.GetCertificate signature
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+}
+
+// tlsConfig returns a TLS config that only allows TLS 1.2 and above with forward-secret
+// AEAD cipher suites (the TLS 1.3 suites are not configurable and are all fine) and the
+// modern curves
+func tlsConfig(cr *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+// redirectToHTTPS returns the handler for the plain HTTP redirect server. Every request is
+// permanently redirected to the same path on the HTTPS port
+func (app *application) redirectToHTTPS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port in the Host header
+			host = r.Host
+		}
+
+		target := "https://" + host
+		if app.config.port != 443 {
+			target = fmt.Sprintf("https://%s:%d", host, app.config.port)
+		}
+		target += r.URL.RequestURI()
+
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// hsts adds the Strict-Transport-Security header to every response when the server is
+// running with TLS and a max age has been configured
+func (app *application) hsts(next http.Handler) http.Handler {
+	if app.config.tls.certFile == "" || app.config.tls.hsts.maxAge <= 0 {
+		return next
+	}
+
+	value := fmt.Sprintf("max-age=%d", int(app.config.tls.hsts.maxAge.Seconds()))
+	if app.config.tls.hsts.includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if app.config.tls.hsts.preload {
+		value += "; preload"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
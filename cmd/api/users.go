@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"greenlight.usman.com/internal/data"
 	"greenlight.usman.com/internal/validator"
@@ -16,6 +18,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// Language is the language for the user's emails. If it isn't given we take the
+		// best match for the Accept-Language header
+		Language string `json:"language"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -26,10 +31,17 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// copy the data from the request body into a new User struct
 
+	v := validator.New()
+
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Language:  strings.ToLower(input.Language),
+	}
+
+	if user.Language == "" {
+		user.Language = app.readLanguage(w, r, v)
 	}
 
 	//we can use the password Set() method to generate and store
@@ -40,8 +52,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	v := validator.New()
-
 	// validate the user struct and return the error message
 	// to the client if any of the checks fail
 	if data.ValidateUser(v, user); !v.Valid() {
@@ -49,8 +59,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// insert the user data into the database
-	err = app.models.Users.Insert(user)
+	// insert the user data into the database, and queue the welcome email in the same
+	// transaction. The job is stored in the database, so it survives a restart and is retried
+	// (with backoff) if the SMTP server is down, see jobs.go. If either fails neither is kept,
+	// and the client can simply register again
+	err = app.models.Users.InsertWithJob(user, func(user *data.User) data.NewJob {
+		return app.newJob(jobWelcomeEmail, welcomeEmailJob{UserID: user.ID})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -62,14 +77,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	app.background(func() {
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", user)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
-
-	// Old process see the helper function above, it has been moved there now
+	// Older process, this was moved into the app.background() helper and then replaced
+	// by the job queue
 	// Launch a goroutine in the background to send the welcome email
 	// go func() {
 
@@ -83,7 +92,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// 	// call the send method on the Mailer, passing in the user's email address,
 	// 	// name of the template file, and the User struct containing the new users data
-	// 	err = app.mailer.Send(user.Email, "user_welcome.tmpl", user)
+	// 	err = app.mailer.Send(user.Email, user.Language, "user_welcome.tmpl", user)
 	// 	if err != nil {
 	// 		app.logger.Error(err.Error())
 	// 	}
@@ -98,3 +107,258 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// emailChangeTokenTTL is how long the user has to confirm a new email address
+const emailChangeTokenTTL = 24 * time.Hour
+
+// updateCurrentUserHandler handles PATCH /v1/users/me, which changes the user's name and email.
+// Changing the email needs the current password as well, as an authentication token on its
+// own is enough to ask for a change to an address the caller controls and confirm it from
+// there. A new email isn't applied straight away: it is kept as the pending email, a token to
+// confirm it is sent to the new address, and a notice to the current one with a token to
+// cancel the change (see cancelEmailChangeHandler). Sending the current email cancels a
+// pending change
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// pointers so that we can tell which fields were left out of the request
+	var input struct {
+		Name     *string `json:"name"`
+		Email    *string `json:"email"`
+		Password *string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	emailChanged := false
+
+	if input.Email != nil {
+		switch {
+		case strings.EqualFold(*input.Email, user.Email):
+			user.PendingEmail = ""
+		default:
+			data.ValidateEmail(v, *input.Email)
+			user.PendingEmail = *input.Email
+			emailChanged = true
+		}
+
+		v.Check(input.Password != nil && *input.Password != "", "password", "must be provided to change the email")
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Email != nil {
+		match, err := user.Password.Matches(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !match {
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	// the address is checked again when the change is confirmed, as it could be taken by then
+	if emailChanged {
+		_, err = app.models.Users.GetByEmail(user.PendingEmail)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// the version from the authentication lookup gives us optimistic locking against
+	// another request updating the user at the same time. A new email is saved along with
+	// the jobs sending the confirmation to it and the notice to the old address, in the same
+	// transaction, and the tokens sent for an earlier change are deleted
+	switch {
+	case emailChanged:
+		err = app.models.Users.RequestEmailChange(user,
+			app.newJob(jobEmailChangeConfirm, emailChangeConfirmJob{UserID: user.ID, NewEmail: user.PendingEmail}),
+			app.newJob(jobEmailChangeNotice, emailChangeNoticeJob{UserID: user.ID, Email: user.Email, Language: user.Language}),
+		)
+	default:
+		err = app.models.Users.Update(user)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler handles PUT /v1/users/email. The token from the email sent to the
+// new address makes the pending email the user's email. Every authentication token the user
+// has is revoked with it, so sessions started before the change (one with a stolen token
+// included) don't outlive it and the user has to sign in again with the new email
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.ConfirmEmailChange(input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelEmailChangeHandler handles DELETE /v1/users/email. The token from the notice sent to
+// the old address clears the pending email, so a change the owner didn't ask for is never
+// made. As someone else has been using the account, all of its authentication tokens are
+// revoked too
+func (app *application) cancelEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.CancelEmailChange(input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activationTokenTTL is how long the activation token from the welcome email is valid for
+const activationTokenTTL = 3 * 24 * time.Hour
+
+// activateUserHandler handles PUT /v1/users/activated, which activates the account with the
+// token sent in the welcome email
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Activated = true
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the token has been used, so it (and any other activation tokens) can go
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
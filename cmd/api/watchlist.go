@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/validator"
+)
+
+// listWatchlistHandler handles GET /v1/users/me/watchlist. The watchlist is in the user's
+// own order unless the client asks for another sort
+func (app *application) listWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:           app.readInt(qs, "page", 1, v),
+		PageSize:       app.readInt(qs, "page_size", 20, v),
+		Sort:           app.readString(qs, "sort", "position"),
+		SortSafelist:   data.WatchlistFields.SortSafelist(),
+		FilterSafelist: data.WatchlistFields.FilterSafelist(),
+	}
+	filters.Conditions = app.readFilters(r.URL.RawQuery, filters.FilterSafelist, v)
+
+	// the movie titles and runtimes are presented like they are in GET /v1/movies
+	lang := app.readLanguage(w, r, v)
+	runtimeFormat := app.readRuntimeFormat(w, r, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.canonicaliseGenreFilters(&filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	entries, metadata, err := app.models.Watchlist.GetAll(app.contextGetUser(r).ID, lang, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies := make([]*data.Movie, 0, len(entries))
+	for _, entry := range entries {
+		entry.Movie.FormatRuntime(runtimeFormat)
+		movies = append(movies, entry.Movie)
+	}
+
+	err = app.includeArtwork(movies...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	if language := contentLanguage(movies...); language != "" {
+		headers.Set("Content-Language", language)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"watchlist": entries, "metadata": metadata}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addToWatchlistHandler handles POST /v1/users/me/watchlist, which adds a movie to the end
+// of the watchlist
+func (app *application) addToWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MovieID int64 `json:"movie_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.MovieID > 0, "movie_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entry, err := app.models.Watchlist.Add(app.contextGetUser(r).ID, input.MovieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "no movie exists with this id")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateWatchlistEntry):
+			v.AddError("movie_id", "this movie is already on your watchlist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelop{"watchlist_entry": entry}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// moveWatchlistEntryHandler handles PATCH /v1/users/me/watchlist/:movie_id, which moves the
+// movie to a new position. A position past the end of the watchlist moves it to the end
+func (app *application) moveWatchlistEntryHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readInt64Param(r, "movie_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Position *int `json:"position"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Position != nil, "position", "must be provided")
+	if input.Position != nil {
+		v.Check(*input.Position >= 1, "position", "must be greater than 0")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	position, err := app.models.Watchlist.Move(app.contextGetUser(r).ID, movieID, *input.Position)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"watchlist_entry": envelop{"movie_id": movieID, "position": position}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeFromWatchlistHandler handles DELETE /v1/users/me/watchlist/:movie_id
+func (app *application) removeFromWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readInt64Param(r, "movie_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Watchlist.Remove(app.contextGetUser(r).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "movie successfully removed from watchlist"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listHistoryHandler handles GET /v1/users/me/history, most recently watched first
+func (app *application) listHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:           app.readInt(qs, "page", 1, v),
+		PageSize:       app.readInt(qs, "page_size", 20, v),
+		Sort:           app.readString(qs, "sort", "-watched_at"),
+		SortSafelist:   data.HistoryFields.SortSafelist(),
+		FilterSafelist: data.HistoryFields.FilterSafelist(),
+	}
+	filters.Conditions = app.readFilters(r.URL.RawQuery, filters.FilterSafelist, v)
+
+	// the movie titles and runtimes are presented like they are in GET /v1/movies
+	lang := app.readLanguage(w, r, v)
+	runtimeFormat := app.readRuntimeFormat(w, r, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.canonicaliseGenreFilters(&filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	entries, metadata, err := app.models.History.GetAll(app.contextGetUser(r).ID, lang, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies := make([]*data.Movie, 0, len(entries))
+	for _, entry := range entries {
+		entry.Movie.FormatRuntime(runtimeFormat)
+		movies = append(movies, entry.Movie)
+	}
+
+	err = app.includeArtwork(movies...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	if language := contentLanguage(movies...); language != "" {
+		headers.Set("Content-Language", language)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"history": entries, "metadata": metadata}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addToHistoryHandler handles POST /v1/users/me/history, which marks a movie as watched.
+// watched_at defaults to now, and marking a movie again just updates the time
+func (app *application) addToHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MovieID   int64      `json:"movie_id"`
+		WatchedAt *time.Time `json:"watched_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	watchedAt := time.Now()
+	if input.WatchedAt != nil {
+		watchedAt = *input.WatchedAt
+	}
+
+	v := validator.New()
+
+	v.Check(input.MovieID > 0, "movie_id", "must be provided")
+	v.Check(!watchedAt.After(time.Now().Add(time.Minute)), "watched_at", "must not be in the future")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entry, err := app.models.History.Add(app.contextGetUser(r).ID, input.MovieID, watchedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "no movie exists with this id")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelop{"history_entry": entry}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeFromHistoryHandler handles DELETE /v1/users/me/history/:movie_id
+func (app *application) removeFromHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readInt64Param(r, "movie_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.History.Remove(app.contextGetUser(r).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "movie successfully removed from history"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
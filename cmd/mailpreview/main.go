@@ -0,0 +1,82 @@
+// Command mailpreview renders an email template with sample data, so that a template can be
+// checked without registering a user or having an SMTP server. For example
+//
+//	go run ./cmd/mailpreview -template user_welcome.tmpl -locale fr
+//	go run ./cmd/mailpreview -template user_welcome.tmpl -part html > /tmp/welcome.html
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"greenlight.usman.com/internal/data"
+	"greenlight.usman.com/internal/mailer"
+)
+
+// samples holds the data each template is rendered with, it has to have the same type as the
+// data the API sends the template with
+var samples = map[string]any{
+	"user_welcome.tmpl": map[string]any{
+		"activationToken": "H4L6PGQXJ2VNR7TYW3KZB5MDCE",
+		"userID":          int64(123),
+	},
+	"email_change_confirm.tmpl": map[string]any{
+		"token":  "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID": int64(123),
+	},
+	"email_change_notice.tmpl": map[string]any{
+		"userID": int64(123),
+	},
+}
+
+func main() {
+	var templateFile, locale, part string
+
+	flag.StringVar(&templateFile, "template", "", "Template to render, eg user_welcome.tmpl (lists the templates if empty)")
+	flag.StringVar(&locale, "locale", mailer.DefaultLocale, "Locale to render the template in ("+strings.Join(data.Languages, "|")+")")
+	flag.StringVar(&part, "part", "all", "Part of the email to print (all|subject|text|html)")
+	flag.Parse()
+
+	// the transport is never used, we only render
+	m, err := mailer.New(nil, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if templateFile == "" {
+		for _, name := range m.Templates() {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	sample, ok := samples[templateFile]
+	if !ok || !slices.Contains(m.Templates(), templateFile) {
+		fmt.Fprintf(os.Stderr, "unknown template %s, use one of: %s\n", templateFile, strings.Join(m.Templates(), ", "))
+		os.Exit(2)
+	}
+
+	rendered, err := m.Render(locale, templateFile, sample)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch part {
+	case "subject":
+		fmt.Println(rendered.Subject)
+	case "text":
+		fmt.Print(rendered.Text)
+	case "html":
+		fmt.Print(rendered.HTML)
+	case "all":
+		fmt.Printf("Subject: %s\n\n--- text/plain ---\n%s\n--- text/html ---\n%s", rendered.Subject, rendered.Text, rendered.HTML)
+	default:
+		fmt.Fprintln(os.Stderr, "part must be all, subject, text or html")
+		os.Exit(2)
+	}
+}
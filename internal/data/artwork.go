@@ -0,0 +1,174 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ArtworkSizes holds the kinds of artwork a movie can have, and the widths of the thumbnails
+// generated for each. The widths follow the sizes commonly used for posters and backdrops
+var ArtworkSizes = map[string][]int{
+	"poster":   {185, 342, 500},
+	"backdrop": {300, 780, 1280},
+}
+
+// Artwork maps each variant of a piece of artwork (original, w185...) to its URL
+type Artwork map[string]string
+
+// ArtworkImage is one stored variant of a movie's poster or backdrop. The Key is where the
+// BlobStore keeps it, the data package doesn't know how that turns into a URL
+type ArtworkImage struct {
+	MovieID     int64
+	Kind        string
+	Variant     string
+	Key         string
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// ArtworkModel wraps the DB connection pool for the movie_artwork table
+type ArtworkModel struct {
+	DB *sql.DB
+}
+
+// Replace swaps the artwork of a kind for a movie for the new images, and returns the keys of
+// the images it replaced so that the caller can delete the blobs. It returns ErrRecordNotFound
+// if the movie doesn't exist
+func (m ArtworkModel) Replace(movieID int64, kind string, images []ArtworkImage) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var old []string
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		query := `DELETE FROM movie_artwork WHERE movie_id = $1 AND kind = $2 RETURNING key`
+
+		rows, err := tx.QueryContext(ctx, query, movieID, kind)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return err
+			}
+			old = append(old, key)
+		}
+		rows.Close()
+
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO movie_artwork (movie_id, kind, variant, key, content_type, width, height)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`
+
+		for _, image := range images {
+			_, err := tx.ExecContext(ctx, query, movieID, kind, image.Variant, image.Key, image.ContentType, image.Width, image.Height)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_artwork" violates foreign key constraint "movie_artwork_movie_id_fkey"`:
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return old, nil
+}
+
+// Delete removes the artwork of a kind from a movie and returns the keys of the removed
+// images. It returns ErrRecordNotFound if the movie had no artwork of that kind
+func (m ArtworkModel) Delete(movieID int64, kind string) ([]string, error) {
+	query := `DELETE FROM movie_artwork WHERE movie_id = $1 AND kind = $2 RETURNING key`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return keys, nil
+}
+
+// GetForMovies returns the artwork for each of the movies, keyed by movie ID. Like the
+// credits, reading them in one query means a movie listing doesn't cost a query per movie
+func (m ArtworkModel) GetForMovies(movieIDs []int64) (map[int64][]ArtworkImage, error) {
+	query := `
+		SELECT movie_id, kind, variant, key, content_type, width, height
+		FROM movie_artwork
+		WHERE movie_id = ANY($1)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movieIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	artwork := make(map[int64][]ArtworkImage, len(movieIDs))
+
+	for rows.Next() {
+		var image ArtworkImage
+
+		err := rows.Scan(
+			&image.MovieID,
+			&image.Kind,
+			&image.Variant,
+			&image.Key,
+			&image.ContentType,
+			&image.Width,
+			&image.Height,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		artwork[image.MovieID] = append(artwork[image.MovieID], image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return artwork, nil
+}
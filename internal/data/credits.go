@@ -0,0 +1,258 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.usman.com/internal/validator"
+)
+
+var (
+	ErrUnknownPerson   = errors.New("unknown person")
+	ErrDuplicateCredit = errors.New("duplicate credit")
+)
+
+// CreditRoles is the safelist of the roles a person can be credited with
+var CreditRoles = []string{"director", "actor", "writer"}
+
+// Credit links a person to a movie with a role, and for actors the character they played
+type Credit struct {
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"-"`
+	MovieID      int64     `json:"movie_id"`
+	PersonID     int64     `json:"person_id"`
+	PersonName   string    `json:"person_name,omitempty"`
+	Role         string    `json:"role"`
+	Character    string    `json:"character,omitempty"`
+	BillingOrder int32     `json:"billing_order"`
+	Version      int32     `json:"version"`
+}
+
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID > 0, "person_id", "must be provided")
+	v.Check(validator.PermittedValue(credit.Role, CreditRoles...), "role", "must be director, actor or writer")
+
+	// only actors play a character
+	if credit.Role == "actor" {
+		v.Check(credit.Character != "", "character", "must be provided for an actor")
+	} else {
+		v.Check(credit.Character == "", "character", "must only be provided for an actor")
+	}
+	v.Check(len(credit.Character) <= 500, "character", "must not be more than 500 bytes long")
+
+	v.Check(credit.BillingOrder >= 0, "billing_order", "must not be negative")
+}
+
+// CreditModel wraps the DB connection pool for the movie_credits table
+type CreditModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a credit to a movie. It returns ErrUnknownPerson if the person doesn't exist
+// and ErrDuplicateCredit if they already have the same credit on the movie
+func (m CreditModel) Insert(credit *Credit) error {
+	query := `
+		INSERT INTO movie_credits (movie_id, person_id, role, character, billing_order)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version
+	`
+
+	args := []any{credit.MovieID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.ID, &credit.CreatedAt, &credit.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_credits" violates foreign key constraint "movie_credits_person_id_fkey"`:
+			return ErrUnknownPerson
+		case err.Error() == `pq: insert or update on table "movie_credits" violates foreign key constraint "movie_credits_movie_id_fkey"`:
+			return ErrRecordNotFound
+		case err.Error() == `pq: duplicate key value violates unique constraint "movie_credits_unique"`:
+			return ErrDuplicateCredit
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns a credit of the movie, with the person's name
+func (m CreditModel) Get(movieID, id int64) (*Credit, error) {
+	if movieID < 1 || id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT c.id, c.created_at, c.movie_id, c.person_id, p.name, c.role, c.character, c.billing_order, c.version
+		FROM movie_credits c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.id = $1 AND c.movie_id = $2
+	`
+
+	var credit Credit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, movieID).Scan(
+		&credit.ID,
+		&credit.CreatedAt,
+		&credit.MovieID,
+		&credit.PersonID,
+		&credit.PersonName,
+		&credit.Role,
+		&credit.Character,
+		&credit.BillingOrder,
+		&credit.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &credit, nil
+}
+
+// Update changes the person, role, character and billing order of a credit. Like the movies
+// it uses the version for optimistic locking, and returns ErrEditConflict if the credit was
+// changed (or deleted) since it was read. ErrUnknownPerson and ErrDuplicateCredit are returned
+// in the same cases as Insert
+func (m CreditModel) Update(credit *Credit) error {
+	query := `
+		UPDATE movie_credits
+		SET person_id = $1, role = $2, character = $3, billing_order = $4, version = version + 1
+		WHERE id = $5 AND movie_id = $6 AND version = $7
+		RETURNING version
+	`
+
+	args := []any{
+		credit.PersonID,
+		credit.Role,
+		credit.Character,
+		credit.BillingOrder,
+		credit.ID,
+		credit.MovieID,
+		credit.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_credits" violates foreign key constraint "movie_credits_person_id_fkey"`:
+			return ErrUnknownPerson
+		case err.Error() == `pq: duplicate key value violates unique constraint "movie_credits_unique"`:
+			return ErrDuplicateCredit
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a credit from a movie
+func (m CreditModel) Delete(movieID, id int64) error {
+	if movieID < 1 || id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM movie_credits WHERE id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForMovies returns the credits for each of the given movies, keyed by movie ID. They are
+// ordered by role, billing order and name. Reading them all in one query means embedding
+// credits in a movie listing doesn't cost a query per movie
+func (m CreditModel) GetForMovies(movieIDs []int64) (map[int64][]*Credit, error) {
+	query := `
+		SELECT c.id, c.created_at, c.movie_id, c.person_id, p.name, c.role, c.character, c.billing_order, c.version
+		FROM movie_credits c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = ANY($1)
+		ORDER BY c.movie_id, c.role, c.billing_order, p.name, c.id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movieIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := make(map[int64][]*Credit, len(movieIDs))
+	for _, id := range movieIDs {
+		credits[id] = []*Credit{}
+	}
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(
+			&credit.ID,
+			&credit.CreatedAt,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.PersonName,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+			&credit.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		credits[credit.MovieID] = append(credits[credit.MovieID], &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// GetForMovie returns the credits for a single movie
+func (m CreditModel) GetForMovie(movieID int64) ([]*Credit, error) {
+	credits, err := m.GetForMovies([]int64{movieID})
+	if err != nil {
+		return nil, err
+	}
+
+	return credits[movieID], nil
+}
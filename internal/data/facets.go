@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+// FacetBucket is the number of matching movies for one value of a facet
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// FacetFields is the safelist for the facets query parameter
+var FacetFields = []string{"genres", "year"}
+
+func ValidateFacets(v *validator.Validator, facets []string) {
+	for _, facet := range facets {
+		v.Check(validator.PermittedValue(facet, FacetFields...), "facets", "must only contain genres or year")
+	}
+	v.Check(validator.Unique(facets), "facets", "must not contain duplicate values")
+}
+
+// facetQueries holds the SELECT for each facet, %s is the CTE holding the movies the facet is
+// counted over (see facets()). The genres facet counts how many of the movies have each genre,
+// and the year facet groups the movies by decade.
+var facetQueries = map[string]string{
+	"genres": `
+		SELECT 'genres', genre, count(*)
+		FROM %s, unnest(genres) AS genre
+		GROUP BY genre`,
+	"year": `
+		SELECT 'year', ((year / 10) * 10)::text || 's', count(*)
+		FROM %s
+		GROUP BY year / 10`,
+}
+
+// withoutField returns the filter conditions which aren't on the field
+func withoutField(conditions []FilterCondition, field string) []FilterCondition {
+	kept := []FilterCondition{}
+
+	for _, c := range conditions {
+		if c.Field != field {
+			kept = append(kept, c)
+		}
+	}
+
+	return kept
+}
+
+// Facets returns the buckets for each of the requested facets, computed over the movies that
+// match the same title search and filter conditions as GetAll, apart from the conditions on
+// the facet's own field. This is disjunctive faceting: with genres=drama the genres facet
+// still lists the other genres and how many movies each would give, rather than collapsing
+// to drama alone. Genre buckets are ordered by count, year buckets by decade.
+func (m MovieModel) Facets(title, language string, mode SearchMode, filters Filters, facets []string) (map[string][]FacetBucket, error) {
+	if mode != SearchAuto {
+		return m.facets(title, language, mode, filters, facets)
+	}
+
+	// follow the same fallback as GetAll. A facet ignores its own filters, so it can have
+	// buckets when nothing matched, and we have to count the matches to tell
+	if title != "" {
+		total, err := m.count(title, language, SearchFullText, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		if total == 0 {
+			return m.facets(title, language, SearchFuzzy, filters, facets)
+		}
+	}
+
+	return m.facets(title, language, SearchFullText, filters, facets)
+}
+
+func (m MovieModel) facets(title, language string, mode SearchMode, filters Filters, facets []string) (map[string][]FacetBucket, error) {
+	result := make(map[string][]FacetBucket, len(facets))
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	match, _, search := searchClause(title, language, mode)
+
+	// the title search is $1 and the language $2 for every facet, each facet's conditions
+	// are appended to args in turn so the placeholders follow on from the last facet's
+	args := []any{search, language}
+
+	ctes := make([]string, 0, len(facets))
+	selects := make([]string, 0, len(facets))
+	for _, facet := range facets {
+		result[facet] = []FacetBucket{}
+
+		// the facet is counted over the movies matching every filter but its own
+		own := filters
+		own.Conditions = withoutField(filters.Conditions, facet)
+
+		var conditions string
+		conditions, args = own.conditionSQL(args)
+
+		cte := "matched_" + facet
+		ctes = append(ctes, fmt.Sprintf(`%s AS (
+			SELECT year, genres
+			FROM movies %s
+			WHERE %s %s
+		)`, cte, movieTranslationJoin, match, conditions))
+		selects = append(selects, fmt.Sprintf(facetQueries[facet], cte))
+	}
+
+	query := fmt.Sprintf(`
+		WITH %s
+		SELECT facet, value, count FROM (%s) AS buckets (facet, value, count)
+		ORDER BY facet, CASE WHEN facet = 'year' THEN 0 ELSE count END DESC, value
+	`, strings.Join(ctes, ",\n\t\t"), strings.Join(selects, "\n\t\tUNION ALL"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			facet  string
+			bucket FacetBucket
+		)
+
+		err := rows.Scan(&facet, &bucket.Value, &bucket.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		result[facet] = append(result[facet], bucket)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,184 @@
+package data
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"greenlight.usman.com/internal/validator"
+)
+
+// SelectSafelist returns the fields which can be requested with the fields query parameter
+func (r FieldRegistry) SelectSafelist() []string {
+	safelist := []string{}
+
+	for name, field := range r {
+		if field.Selectable {
+			safelist = append(safelist, name)
+		}
+	}
+	sort.Strings(safelist)
+
+	return safelist
+}
+
+// ValidateFieldset checks the fields and include query parameters. An empty fields list
+// means every field
+func ValidateFieldset(v *validator.Validator, fields, selectSafelist, includes, includeSafelist []string) {
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, selectSafelist...), "fields", "unknown field "+field)
+	}
+	v.Check(validator.Unique(fields), "fields", "must not contain duplicate values")
+
+	for _, include := range includes {
+		v.Check(validator.PermittedValue(include, includeSafelist...), "include", "unknown relation "+include)
+	}
+	v.Check(validator.Unique(includes), "include", "must not contain duplicate values")
+}
+
+// MovieIncludeSafelist holds the related resources that can be embedded in a movie
+// response with the include query parameter
+var MovieIncludeSafelist = []string{"credits"}
+
+// movieColumns maps each selectable movie field to its columns and the scan destinations
+// for them, so that we can build the SELECT list and the Scan() arguments from the fields
+// a client asked for. Most fields are a single column, the rating is two. The title and
+// synopsis come from movieTranslationJoin, so every query using these has to include it
+var movieColumns = map[string]struct {
+	column string
+	dest   func(*Movie) []any
+}{
+	"id":                    {"id", func(m *Movie) []any { return []any{&m.ID} }},
+	"title":                 {translatedTitle, func(m *Movie) []any { return []any{&m.Title} }},
+	"synopsis":              {translatedSynopsis, func(m *Movie) []any { return []any{&m.Synopsis} }},
+	"year":                  {"year", func(m *Movie) []any { return []any{&m.Year} }},
+	"runtime":               {"runtime", func(m *Movie) []any { return []any{&m.Runtime} }},
+	"genres":                {"genres", func(m *Movie) []any { return []any{pq.Array(&m.Genres)} }},
+	"content_rating_system": {"content_rating_system", func(m *Movie) []any { return []any{&m.ContentRatingSystem} }},
+	"content_rating":        {"content_rating", func(m *Movie) []any { return []any{&m.ContentRating} }},
+	"release_dates":         {"release_dates", func(m *Movie) []any { return []any{&m.ReleaseDates} }},
+	"original_language":     {"original_language", func(m *Movie) []any { return []any{&m.OriginalLanguage} }},
+	// the external IDs are NULL when they aren't set
+	"imdb_id": {"COALESCE(imdb_id, '')", func(m *Movie) []any { return []any{&m.ImdbID} }},
+	"tmdb_id": {"COALESCE(tmdb_id, 0)", func(m *Movie) []any { return []any{&m.TmdbID} }},
+	"rating":  {"rating_average, rating_count", func(m *Movie) []any { return []any{&m.Rating.Average, &m.Rating.Count} }},
+	"version": {"version", func(m *Movie) []any { return []any{&m.Version} }},
+	// the artwork is read from movie_artwork by the handlers, so it has no columns here
+	"poster":   {"", nil},
+	"backdrop": {"", nil},
+}
+
+// movieFieldOrder is the order the columns are selected in when every field is wanted
+var movieFieldOrder = []string{
+	"id", "title", "synopsis", "year", "runtime", "genres", "content_rating_system", "content_rating",
+	"release_dates", "original_language", "imdb_id", "tmdb_id", "rating", "version", "poster", "backdrop",
+}
+
+// movieSelect returns the SELECT list and a function returning the Scan() destinations
+// for a movie. With no fields every column is selected, created_at included. The language
+// the title is served in is always read, whatever the fields, for the Content-Language header
+func movieSelect(fields []string) (string, func(*Movie) []any) {
+	if len(fields) == 0 {
+		columns := []string{
+			"id", "created_at", translatedTitle, translatedSynopsis, "year", "runtime", "genres",
+			"content_rating_system", "content_rating", "release_dates", "original_language",
+			"COALESCE(imdb_id, '')", "COALESCE(tmdb_id, 0)", "rating_average", "rating_count", "version",
+			servedLanguage,
+		}
+
+		return strings.Join(columns, ", "), func(m *Movie) []any {
+			return []any{
+				&m.ID, &m.CreatedAt, &m.Title, &m.Synopsis, &m.Year, &m.Runtime, pq.Array(&m.Genres),
+				&m.ContentRatingSystem, &m.ContentRating, &m.ReleaseDates, &m.OriginalLanguage,
+				&m.ImdbID, &m.TmdbID, &m.Rating.Average, &m.Rating.Count, &m.Version,
+				&m.language,
+			}
+		}
+	}
+
+	// keep the columns in a fixed order, whatever order the fields were requested in.
+	// The id is always read, as it is needed to load any included relations, but it is
+	// only sent to the client if it was asked for. So is the language, which is never sent
+	selected := []string{}
+	columns := []string{"id", servedLanguage}
+	for _, name := range movieFieldOrder {
+		for _, field := range fields {
+			if field == name {
+				selected = append(selected, name)
+				if name != "id" && movieColumns[name].column != "" {
+					columns = append(columns, movieColumns[name].column)
+				}
+			}
+		}
+	}
+
+	return strings.Join(columns, ", "), func(m *Movie) []any {
+		m.fields = selected
+
+		dest := []any{&m.ID, &m.language}
+		for _, name := range selected {
+			if name != "id" && movieColumns[name].dest != nil {
+				dest = append(dest, movieColumns[name].dest(m)...)
+			}
+		}
+		return dest
+	}
+}
+
+// MarshalJSON encodes the movie as usual, with the runtime in the requested format, then drops
+// every key that wasn't selected when the movie was read with a sparse fieldset
+func (m Movie) MarshalJSON() ([]byte, error) {
+	// movieJSON has the same fields and tags as Movie but not this method, so encoding
+	// it doesn't recurse
+	type movieJSON Movie
+
+	// the Runtime field here takes precedence over the one in the embedded movieJSON, as it
+	// is less deeply nested, so the runtime is written by Format() rather than MarshalJSON()
+	js, err := json.Marshal(struct {
+		movieJSON
+		Runtime any `json:"runtime,omitempty"`
+	}{
+		movieJSON: movieJSON(m),
+		Runtime:   runtimeOrNil(m.Runtime, m.runtimeFormat),
+	})
+	if err != nil || m.fields == nil {
+		return js, err
+	}
+
+	all := make(map[string]json.RawMessage)
+	err = json.Unmarshal(js, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	sparse := make(map[string]json.RawMessage, len(m.fields))
+	for _, field := range m.fields {
+		value, ok := all[field]
+		if !ok {
+			// omitempty dropped it, send the zero value rather than leaving it out
+			value = json.RawMessage("null")
+		}
+		sparse[field] = value
+	}
+
+	// related resources are only present when they were asked for with include=, so
+	// they are kept whatever the fieldset
+	for _, include := range MovieIncludeSafelist {
+		if value, ok := all[include]; ok {
+			sparse[include] = value
+		}
+	}
+
+	return json.Marshal(sparse)
+}
+
+// runtimeOrNil formats the runtime, or returns nil for a zero runtime so that omitempty
+// leaves it out as before
+func runtimeOrNil(runtime Runtime, format RuntimeFormat) any {
+	if runtime == 0 {
+		return nil
+	}
+
+	return runtime.Format(format)
+}
@@ -1,7 +1,16 @@
 package data
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 
 	"greenlight.usman.com/internal/validator"
 )
@@ -14,6 +23,12 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Conditions are the field filters parsed from the query string, eg year>=1990.
+	// Like the sort, each one is checked against a safelist of fields and operators
+	Conditions     []FilterCondition
+	FilterSafelist map[string]FilterField
+	// Fields is the sparse fieldset to return, empty means every field
+	Fields []string
 }
 
 // metadata struct for holding the pagination data
@@ -31,28 +46,98 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than 0")
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than 0")
-	v.Check(f.Page <= 100, "page_size", "must be a maximum of 100")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+
+	// The sort parameter is a comma separated list of keys, eg sort=-year,title. Check that
+	// each key matches a value in the safelist and that no column is sorted on twice
+	keys := f.sortKeys()
+	v.Check(len(keys) > 0, "sort", "must be provided")
+	v.Check(len(keys) <= maxSortKeys, "sort", fmt.Sprintf("must not contain more than %d keys", maxSortKeys))
+
+	columns := make([]string, 0, len(keys))
+	for _, key := range keys {
+		v.Check(validator.PermittedValue(key, f.SortSafelist...), "sort", "invalid sort value "+strconv.Quote(key))
+		columns = append(columns, strings.TrimPrefix(key, "-"))
+	}
+	v.Check(validator.Unique(columns), "sort", "must not sort on the same field twice")
+
+	// Check every filter condition against the field safelist
+	for _, c := range f.Conditions {
+		field, ok := f.FilterSafelist[c.Field]
+		if !ok {
+			v.AddError(c.Field, "unknown filter field")
+			continue
+		}
+
+		if !validator.PermittedValue(c.Operator, field.Operators...) {
+			v.AddError(c.Field, fmt.Sprintf("unsupported operator %q", c.Operator))
+			continue
+		}
 
-	// Check that the sort parameter matches a value in the safelist
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+		_, err := field.Type.parse(c.Value)
+		if err != nil {
+			v.AddError(c.Field, err.Error())
+		}
+	}
 }
 
-// Helper functions to get the sortColumn and sortDirection
-func (f *Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// maxSortKeys is the most keys a sort parameter can have
+const maxSortKeys = 5
+
+// sortKeys splits the sort parameter into its keys
+func (f *Filters) sortKeys() []string {
+	keys := []string{}
+
+	for _, key := range strings.Split(f.Sort, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
 		}
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+
+	return keys
+}
+
+// hasSortKey reports whether key is one of the sort keys
+func (f *Filters) hasSortKey(key string) bool {
+	return slices.Contains(f.sortKeys(), key)
 }
 
-func (f *Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+// orderBy returns the ORDER BY list for the sort keys. A leading hyphen sorts the column in
+// descending order. Keys which aren't plain columns (like relevance) are looked up in
+// expressions, which holds the full SQL for them including the direction. The list always
+// ends with id, so that rows with equal sort values come back in a consistent order and
+// pagination is stable. Like before, a key that isn't in the safelist causes a panic, as it
+// means ValidateFilters() was not called.
+func (f *Filters) orderBy(expressions map[string]string) string {
+	clauses := []string{}
+	sortedByID := false
+
+	for _, key := range f.sortKeys() {
+		if !slices.Contains(f.SortSafelist, key) {
+			panic("unsafe sort parameter: " + key)
+		}
+
+		if expression, ok := expressions[key]; ok {
+			clauses = append(clauses, expression)
+			continue
+		}
+
+		column := strings.TrimPrefix(key, "-")
+		direction := "ASC"
+		if strings.HasPrefix(key, "-") {
+			direction = "DESC"
+		}
+
+		clauses = append(clauses, column+" "+direction)
+		sortedByID = sortedByID || column == "id"
+	}
+
+	if !sortedByID {
+		clauses = append(clauses, "id ASC")
 	}
 
-	return "ASC"
+	return strings.Join(clauses, ", ")
 }
 
 // Helpers for pagination
@@ -77,3 +162,192 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// FilterOperator is a comparison used in a filter condition
+type FilterOperator string
+
+const (
+	OpEq  FilterOperator = "eq"
+	OpNe  FilterOperator = "ne"
+	OpGt  FilterOperator = "gt"
+	OpGte FilterOperator = "gte"
+	OpLt  FilterOperator = "lt"
+	OpLte FilterOperator = "lte"
+	// the array operators: contains all of, contains any of, contains none of
+	OpAll  FilterOperator = "all"
+	OpAny  FilterOperator = "any"
+	OpNone FilterOperator = "none"
+)
+
+// ComparisonOperators are the operators that make sense for numbers and timestamps
+var ComparisonOperators = []FilterOperator{OpEq, OpNe, OpGt, OpGte, OpLt, OpLte}
+
+// ArrayOperators are the operators for array columns like genres
+var ArrayOperators = []FilterOperator{OpAll, OpAny, OpNone}
+
+// FilterType is the type of value a filter field accepts
+type FilterType int
+
+const (
+	FilterInt FilterType = iota
+	FilterTime
+	FilterString
+	FilterStringArray
+	// FilterRuntime takes a runtime in any form ParseRuntime() accepts, eg runtime<=2h
+	FilterRuntime
+	// FilterFloat takes a decimal number, eg rating>=3.5
+	FilterFloat
+)
+
+// parse converts the raw query string value into the type bound to the SQL placeholder
+func (t FilterType) parse(value string) (any, error) {
+	if value == "" {
+		return nil, errors.New("must be provided")
+	}
+
+	switch t {
+	case FilterInt:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("must be an integer value")
+		}
+		return i, nil
+	case FilterFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New("must be a number")
+		}
+		return f, nil
+	case FilterTime:
+		// accept either a full RFC 3339 timestamp or just a date
+		for _, layout := range []string{time.RFC3339, time.DateOnly} {
+			t, err := time.Parse(layout, value)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return nil, errors.New("must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	case FilterStringArray:
+		return pq.Array(strings.Split(value, ",")), nil
+	case FilterRuntime:
+		runtime, err := ParseRuntime(value)
+		if err != nil {
+			return nil, errors.New("must be a runtime, eg 142, 2h 22m or PT2H22M")
+		}
+		return int32(runtime), nil
+	default:
+		return value, nil
+	}
+}
+
+// FilterField describes a field that can be filtered on: the SQL expression it maps to,
+// the type of its value and which operators are allowed
+type FilterField struct {
+	Column    string
+	Type      FilterType
+	Operators []FilterOperator
+	// Template, if set, is used instead of Column and the operator for fields that don't map
+	// to a column of the table, eg a subquery. It has a single %s for the placeholder
+	Template string
+}
+
+// FilterCondition is a single parsed filter, eg year>=1990 is {"year", OpGte, "1990"}
+type FilterCondition struct {
+	Field    string
+	Operator FilterOperator
+	Value    string
+}
+
+// sqlOperators maps the operators to their SQL form, %s is the column and %s the placeholder
+var sqlOperators = map[FilterOperator]string{
+	OpEq:   "%s = %s",
+	OpNe:   "%s <> %s",
+	OpGt:   "%s > %s",
+	OpGte:  "%s >= %s",
+	OpLt:   "%s < %s",
+	OpLte:  "%s <= %s",
+	OpAll:  "%s @> %s",
+	OpAny:  "%s && %s",
+	OpNone: "NOT %s && %s",
+}
+
+// conditionSQL returns the filter conditions as SQL (each prefixed with AND) and appends their
+// values to args. The columns come from the safelist and the values are always passed as
+// placeholders, so nothing from the client is interpolated into the query. Like orderBy()
+// this panics on a field that isn't in the safelist, ValidateFilters() must be called first.
+func (f *Filters) conditionSQL(args []any) (string, []any) {
+	var sb strings.Builder
+
+	for _, c := range f.Conditions {
+		field, ok := f.FilterSafelist[c.Field]
+		if !ok || !validator.PermittedValue(c.Operator, field.Operators...) {
+			panic("unsafe filter condition: " + c.Field + " " + string(c.Operator))
+		}
+
+		value, err := field.Type.parse(c.Value)
+		if err != nil {
+			panic("invalid filter value: " + c.Field + " " + c.Value)
+		}
+
+		args = append(args, value)
+		placeholder := fmt.Sprintf("$%d", len(args))
+
+		sb.WriteString("\n\t\tAND ")
+		if field.Template != "" {
+			sb.WriteString(fmt.Sprintf(field.Template, placeholder))
+		} else {
+			sb.WriteString(fmt.Sprintf(sqlOperators[c.Operator], field.Column, placeholder))
+		}
+	}
+
+	return sb.String(), args
+}
+
+// Field describes a field of a resource as seen from the query string: the column it maps to,
+// whether it can be sorted on or requested in a sparse fieldset, and which filter operators
+// it accepts (none if Operators is nil)
+type Field struct {
+	Column     string
+	Sortable   bool
+	Selectable bool
+	Filter     FilterType
+	Operators  []FilterOperator
+	// FilterTemplate is copied to FilterField.Template
+	FilterTemplate string
+}
+
+// FieldRegistry holds the fields of a resource keyed by their query string name. The sort and
+// filter safelists are generated from it, so a field can't be sortable in one direction only
+type FieldRegistry map[string]Field
+
+// SortSafelist returns every sortable field in both directions, plus any extra keys
+func (r FieldRegistry) SortSafelist(extra ...string) []string {
+	safelist := []string{}
+
+	for name, field := range r {
+		if field.Sortable {
+			safelist = append(safelist, name, "-"+name)
+		}
+	}
+	sort.Strings(safelist)
+
+	return append(safelist, extra...)
+}
+
+// FilterSafelist returns the fields which can be filtered on
+func (r FieldRegistry) FilterSafelist() map[string]FilterField {
+	safelist := make(map[string]FilterField)
+
+	for name, field := range r {
+		if len(field.Operators) > 0 {
+			safelist[name] = FilterField{
+				Column:    field.Column,
+				Type:      field.Filter,
+				Operators: field.Operators,
+				Template:  field.FilterTemplate,
+			}
+		}
+	}
+
+	return safelist
+}
@@ -0,0 +1,544 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+	"golang.org/x/text/unicode/norm"
+	"greenlight.usman.com/internal/validator"
+)
+
+var (
+	ErrDuplicateGenre = errors.New("duplicate genre")
+	ErrGenreInUse     = errors.New("genre in use")
+	ErrUnknownGenre   = errors.New("unknown genre")
+)
+
+// Genre is an entry in the managed genre taxonomy. Movies store the slug of each of their
+// genres. Aliases are other spellings which are turned into the slug when a movie is written,
+// eg the sci-fi genre might have the aliases science-fiction and scifi
+type Genre struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Aliases   []string  `json:"aliases"`
+	Version   int32     `json:"version"`
+}
+
+// normalise makes sure a genre with no aliases has an empty slice rather than nil, so that it
+// is sent as [] rather than null and stored as '{}' rather than NULL
+func (g *Genre) normalise() {
+	if g.Aliases == nil {
+		g.Aliases = []string{}
+	}
+}
+
+// transliterations are the letters which don't decompose into a base letter and accents, they
+// are spelled out the same way as the unaccent extension does in the genres migration
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i",
+}
+
+// fold lower cases s and transliterates it to ASCII where it can, "Comédie" becomes "comedie".
+// The accents are split off the letters (NFKD) and dropped
+func fold(s string) string {
+	var sb strings.Builder
+
+	for _, r := range norm.NFKD.String(strings.ToLower(s)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case transliterations[r] != "":
+			sb.WriteString(transliterations[r])
+		default:
+			sb.WriteRune(r)
+		}
+	}
+
+	return sb.String()
+}
+
+// Slugify lower cases and transliterates s (see fold), and turns every run of characters other
+// than a-z and 0-9 into a single hyphen, so "Sci-Fi", "sci fi" and " SCI-FI " all become sci-fi
+// and "Comédie" becomes comedie. The genres migration does the same in SQL, the two have to
+// stay in step
+func Slugify(s string) string {
+	var sb strings.Builder
+
+	hyphen := false
+	for _, r := range fold(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+
+	return sb.String()
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(genre.Slug != "", "slug", "must be provided")
+	v.Check(len(genre.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+	v.Check(Slugify(genre.Slug) == genre.Slug, "slug", "must only contain lower case letters, digits and single hyphens")
+
+	v.Check(strings.TrimSpace(genre.Name) != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+	for _, alias := range genre.Aliases {
+		v.Check(alias != "", "aliases", "must not contain empty values")
+		v.Check(alias != genre.Slug, "aliases", "must not contain the slug")
+	}
+	v.Check(validator.Unique(genre.Aliases), "aliases", "must not contain duplicate values")
+}
+
+// GenreTaxonomy maps the slug and every alias of each genre to the genre's slug
+type GenreTaxonomy map[string]string
+
+// Canonicalise returns the slugs for the genres, dropping any duplicates that mapping the
+// aliases creates. Genres which aren't in the taxonomy are returned unchanged, for
+// ValidateMovie() to report. A nil slice stays nil, so a missing genres field is still missing
+func (t GenreTaxonomy) Canonicalise(genres []string) []string {
+	if genres == nil {
+		return nil
+	}
+
+	canonical := make([]string, 0, len(genres))
+	for _, genre := range genres {
+		if slug, ok := t[Slugify(genre)]; ok {
+			genre = slug
+		}
+
+		if !slices.Contains(canonical, genre) {
+			canonical = append(canonical, genre)
+		}
+	}
+
+	return canonical
+}
+
+// Known reports whether genre is the slug of a genre, rather than an alias or an unknown value
+func (t GenreTaxonomy) Known(genre string) bool {
+	slug, ok := t[genre]
+	return ok && slug == genre
+}
+
+// CanonicaliseConditions rewrites the values of the conditions on the genres field as slugs,
+// so genres=Sci-Fi,Drama matches the movies stored with sci-fi and drama
+func (t GenreTaxonomy) CanonicaliseConditions(conditions []FilterCondition) {
+	for i, c := range conditions {
+		if c.Field == "genres" && c.Value != "" {
+			conditions[i].Value = strings.Join(t.Canonicalise(strings.Split(c.Value, ",")), ",")
+		}
+	}
+}
+
+// GenreModel wraps the DB connection pool for the genres table
+type GenreModel struct {
+	DB *sql.DB
+}
+
+// Taxonomy reads the slugs and aliases of every genre. The table is small, so it is read in
+// full whenever a movie is written
+func (m GenreModel) Taxonomy() (GenreTaxonomy, error) {
+	query := `SELECT slug, aliases FROM genres`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	taxonomy := make(GenreTaxonomy)
+
+	for rows.Next() {
+		var (
+			slug    string
+			aliases []string
+		)
+
+		err := rows.Scan(&slug, pq.Array(&aliases))
+		if err != nil {
+			return nil, err
+		}
+
+		taxonomy[slug] = slug
+		for _, alias := range aliases {
+			taxonomy[alias] = slug
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return taxonomy, nil
+}
+
+// GetAll returns every genre ordered by name
+func (m GenreModel) GetAll() ([]*Genre, error) {
+	query := `
+		SELECT id, created_at, slug, name, aliases, version
+		FROM genres
+		ORDER BY name, id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&genre.ID, &genre.CreatedAt, &genre.Slug, &genre.Name, pq.Array(&genre.Aliases), &genre.Version)
+		if err != nil {
+			return nil, err
+		}
+		genre.normalise()
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// Get returns the genre with the slug
+func (m GenreModel) Get(slug string) (*Genre, error) {
+	query := `
+		SELECT id, created_at, slug, name, aliases, version
+		FROM genres
+		WHERE slug = $1
+	`
+
+	var genre Genre
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, slug).Scan(
+		&genre.ID,
+		&genre.CreatedAt,
+		&genre.Slug,
+		&genre.Name,
+		pq.Array(&genre.Aliases),
+		&genre.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	genre.normalise()
+
+	return &genre, nil
+}
+
+// lockGenres stops any other change to the genres until the transaction ends. A slug or alias
+// has to be unique across the slugs and aliases of every genre, which a unique constraint
+// can't express, so the check and the write have to happen without anyone else writing.
+// Reads aren't blocked, and changes to the taxonomy are rare.
+func lockGenres(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `LOCK TABLE genres IN SHARE ROW EXCLUSIVE MODE`)
+	return err
+}
+
+// checkGenreNames returns ErrDuplicateGenre if the slug or any of the aliases of the genre is
+// already the slug or an alias of another genre
+func checkGenreNames(ctx context.Context, tx *sql.Tx, genre *Genre) error {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM genres
+			WHERE id <> $1 AND (slug = ANY($2) OR aliases && $2)
+		)
+	`
+
+	names := append([]string{genre.Slug}, genre.Aliases...)
+
+	var exists bool
+
+	err := tx.QueryRowContext(ctx, query, genre.ID, pq.Array(names)).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return ErrDuplicateGenre
+	}
+
+	return nil
+}
+
+// Insert adds a genre. It returns ErrDuplicateGenre if the slug or an alias is already used
+func (m GenreModel) Insert(genre *Genre) error {
+	query := `
+		INSERT INTO genres (slug, name, aliases)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version
+	`
+
+	genre.normalise()
+
+	args := []any{genre.Slug, genre.Name, pq.Array(genre.Aliases)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockGenres(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		err = checkGenreNames(ctx, tx, genre)
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRowContext(ctx, query, args...).Scan(&genre.ID, &genre.CreatedAt, &genre.Version)
+	})
+}
+
+// Update changes a genre, using the version number for optimistic locking. If the slug has
+// changed the movies are moved over to the new slug (with a movie.updated event for each), and
+// the old slug is kept as an alias so clients still sending it keep working
+func (m GenreModel) Update(genre *Genre, oldSlug string) error {
+	genre.normalise()
+
+	if genre.Slug != oldSlug && !slices.Contains(genre.Aliases, oldSlug) {
+		genre.Aliases = append(genre.Aliases, oldSlug)
+	}
+
+	query := `
+		UPDATE genres
+		SET slug = $1, name = $2, aliases = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+	`
+
+	args := []any{genre.Slug, genre.Name, pq.Array(genre.Aliases), genre.ID, genre.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockGenres(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		err = checkGenreNames(ctx, tx, genre)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&genre.Version)
+		if err != nil {
+			return err
+		}
+
+		if genre.Slug == oldSlug {
+			return nil
+		}
+
+		query := `
+			UPDATE movies
+			SET genres = array_replace(genres, $1, $2), version = version + 1
+			WHERE genres @> ARRAY[$1::text]
+			RETURNING id
+		`
+
+		return updateMoviesWithEvents(ctx, tx, query, oldSlug, genre.Slug)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a genre. Without mergeInto it returns ErrGenreInUse if any movie has the
+// genre. With mergeInto the movies are moved over to that genre first (with a movie.updated
+// event for each), and the deleted slug and its aliases become aliases of it, so the two
+// genres end up as one. It returns ErrUnknownGenre if mergeInto doesn't exist
+func (m GenreModel) Delete(slug, mergeInto string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockGenres(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		var aliases []string
+
+		err = tx.QueryRowContext(ctx, `DELETE FROM genres WHERE slug = $1 RETURNING aliases`, slug).Scan(pq.Array(&aliases))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+
+		if mergeInto == "" {
+			var used bool
+
+			err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM movies WHERE genres @> ARRAY[$1::text])`, slug).Scan(&used)
+			if err != nil {
+				return err
+			}
+
+			if used {
+				return ErrGenreInUse
+			}
+
+			return nil
+		}
+
+		query := `
+			UPDATE genres
+			SET aliases = ARRAY(SELECT DISTINCT unnest(aliases || $2::text[])), version = version + 1
+			WHERE slug = $1
+		`
+
+		result, err := tx.ExecContext(ctx, query, mergeInto, pq.Array(append([]string{slug}, aliases...)))
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrUnknownGenre
+		}
+
+		// movies which already have both genres just lose the deleted one
+		query = `
+			UPDATE movies
+			SET genres = CASE
+				WHEN genres @> ARRAY[$2::text] THEN array_remove(genres, $1)
+				ELSE array_replace(genres, $1, $2)
+			END, version = version + 1
+			WHERE genres @> ARRAY[$1::text]
+			RETURNING id
+		`
+
+		return updateMoviesWithEvents(ctx, tx, query, slug, mergeInto)
+	})
+}
+
+// updateMoviesWithEvents runs an UPDATE of the movies which returns their IDs, and writes a
+// movie.updated event to the webhook outbox for each of them, in the same transaction. A
+// change to a genre changes the movies with it, and the subscribers need to hear about it
+// just as if the movies had been edited one by one
+func updateMoviesWithEvents(ctx context.Context, tx *sql.Tx, query string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// read the movies as they are now, with the original titles (the language is $2 in
+	// movieTranslationJoin), for the event payloads
+	columns, dest := movieSelect(nil)
+
+	movieQuery := fmt.Sprintf(`
+		SELECT %s
+		FROM movies %s
+		WHERE id = ANY($1)
+		ORDER BY id
+	`, columns, movieTranslationJoin)
+
+	rows, err = tx.QueryContext(ctx, movieQuery, pq.Array(ids), "")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(dest(&movie)...)
+		if err != nil {
+			return err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// the rows have to be closed before anything else can run on the transaction
+	rows.Close()
+
+	for _, movie := range movies {
+		err := insertWebhookEvent(ctx, tx, EventMovieUpdated, movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"strconv"
+	"time"
+)
+
+// HistoryEntry records that a user has watched a movie. Watching it again just moves
+// WatchedAt forward, the history holds each movie once
+type HistoryEntry struct {
+	MovieID   int64     `json:"movie_id"`
+	WatchedAt time.Time `json:"watched_at"`
+	Movie     *Movie    `json:"movie,omitempty"`
+}
+
+// HistoryFields is the registry of the fields the watch history can be sorted and filtered
+// on. The movie fields come from the joined movies table
+var HistoryFields = FieldRegistry{
+	"watched_at": {Column: "watched_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"title":      {Column: "title", Sortable: true},
+	"year":       {Column: "year", Sortable: true, Filter: FilterInt, Operators: ComparisonOperators},
+	"genres":     {Column: "genres", Filter: FilterStringArray, Operators: ArrayOperators},
+}
+
+// HistoryModel wraps the DB connection pool for the watch_history table
+type HistoryModel struct {
+	DB *sql.DB
+}
+
+// Add marks a movie as watched at the given time. If it was already in the history the time
+// is updated instead. It returns ErrRecordNotFound if the movie doesn't exist
+func (m HistoryModel) Add(userID, movieID int64, watchedAt time.Time) (*HistoryEntry, error) {
+	query := `
+		INSERT INTO watch_history (user_id, movie_id, watched_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, movie_id) DO UPDATE SET watched_at = EXCLUDED.watched_at
+		RETURNING watched_at
+	`
+
+	entry := &HistoryEntry{MovieID: movieID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, movieID, watchedAt).Scan(&entry.WatchedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "watch_history" violates foreign key constraint "watch_history_movie_id_fkey"`:
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// Remove takes a movie out of the user's watch history
+func (m HistoryModel) Remove(userID, movieID int64) error {
+	if userID < 1 || movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM watch_history WHERE user_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll returns a page of the user's watch history with the movies embedded, their titles
+// translated into the language
+func (m HistoryModel) GetAll(userID int64, language string, filters Filters) ([]*HistoryEntry, Metadata, error) {
+	conditions, args := filters.conditionSQL([]any{userID, language})
+	args = append(args, filters.limit(), filters.offset())
+
+	// the movie columns aren't qualified, none of them clash with the history columns
+	columns, dest := movieSelect(nil)
+
+	query := fmt.Sprintf(`
+		SELECT count(*) over(), h.movie_id, h.watched_at, %s
+		FROM watch_history h
+		INNER JOIN movies ON movies.id = h.movie_id %s
+		WHERE h.user_id = $1 %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, columns, movieTranslationJoin, conditions, filters.orderBy(translatedTitleOrder), len(args)-1, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*HistoryEntry{}
+
+	for rows.Next() {
+		entry := HistoryEntry{Movie: &Movie{}}
+
+		err := rows.Scan(append([]any{&totalRecords, &entry.MovieID, &entry.WatchedAt}, dest(entry.Movie)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return entries, metadata, nil
+}
+
+// AddWatchedFilter narrows a movie listing to the movies the user has watched, or with
+// watched false to the ones they haven't. The user comes from the token rather than the
+// query string, so it is added here instead of being parsed by readFilters(). The safelist
+// is copied first, as it is usually the shared MovieFilterSafelist
+func (f *Filters) AddWatchedFilter(userID int64, watched bool) {
+	template := "id IN (SELECT movie_id FROM watch_history WHERE user_id = %s)"
+	if !watched {
+		template = "id NOT IN (SELECT movie_id FROM watch_history WHERE user_id = %s)"
+	}
+
+	f.FilterSafelist = maps.Clone(f.FilterSafelist)
+	if f.FilterSafelist == nil {
+		f.FilterSafelist = make(map[string]FilterField)
+	}
+	f.FilterSafelist["watched"] = FilterField{
+		Type:      FilterInt,
+		Operators: []FilterOperator{OpEq},
+		Template:  template,
+	}
+
+	f.Conditions = append(f.Conditions, FilterCondition{
+		Field:    "watched",
+		Operator: OpEq,
+		Value:    strconv.FormatInt(userID, 10),
+	})
+}
@@ -0,0 +1,310 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrJobNotDead = errors.New("job not dead")
+
+// The states of a job. A job which fails is put back to pending until it has used up its
+// attempts, then it is dead (the dead-letter state) and stays there unless it is retried
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+// Job is a unit of background work. The type says what to do and the payload holds the
+// arguments as JSON, both are interpreted by the handler registered for the type
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int32           `json:"attempts"`
+	MaxAttempts int32           `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// JobFields is the registry of the fields the job listing can sort and filter on
+var JobFields = FieldRegistry{
+	"id":         {Column: "id", Sortable: true},
+	"created_at": {Column: "created_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"run_at":     {Column: "run_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"status":     {Column: "status", Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"type":       {Column: "type", Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"attempts":   {Column: "attempts", Sortable: true, Filter: FilterInt, Operators: ComparisonOperators},
+}
+
+// jobColumns is the SELECT (and RETURNING) list for a Job
+const jobColumns = `id, created_at, type, payload, status, attempts, max_attempts, run_at, last_error, finished_at`
+
+func jobDest(job *Job) []any {
+	return []any{
+		&job.ID,
+		&job.CreatedAt,
+		&job.Type,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+		&job.FinishedAt,
+	}
+}
+
+// JobModel wraps the DB connection pool for the jobs table
+type JobModel struct {
+	DB *sql.DB
+}
+
+// NewJob is a job to add to the queue in the same transaction as the change it follows on
+// from, see UserModel.InsertWithJob() and UserModel.RequestEmailChange()
+type NewJob struct {
+	Type        string
+	Payload     any
+	MaxAttempts int
+}
+
+// insertJob adds the job to the queue as part of tx, so it is only run if tx commits. The
+// payload is encoded to JSON
+func insertJob(ctx context.Context, tx *sql.Tx, newJob NewJob) (*Job, error) {
+	js, err := json.Marshal(newJob.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO jobs (type, payload, max_attempts)
+		VALUES ($1, $2, $3)
+		RETURNING %s
+	`, jobColumns)
+
+	var job Job
+
+	err = tx.QueryRowContext(ctx, query, newJob.Type, js, newJob.MaxAttempts).Scan(jobDest(&job)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// Enqueue adds a job to run as soon as a worker is free. The payload is encoded to JSON
+func (m JobModel) Enqueue(jobType string, payload any, maxAttempts int) (*Job, error) {
+	var job *Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var err error
+		job, err = insertJob(ctx, tx, NewJob{Type: jobType, Payload: payload, MaxAttempts: maxAttempts})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Get returns a job
+func (m JobModel) Get(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE id = $1`, jobColumns)
+
+	var job Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(jobDest(&job)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// GetAll returns the jobs matching the filters, eg status=dead for the dead-letter queue
+func (m JobModel) GetAll(filters Filters) ([]*Job, Metadata, error) {
+	conditions, args := filters.conditionSQL([]any{})
+	args = append(args, filters.limit(), filters.offset())
+
+	query := fmt.Sprintf(`
+		SELECT count(*) over(), %s
+		FROM jobs
+		WHERE true %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, jobColumns, conditions, filters.orderBy(nil), len(args)-1, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	jobs := []*Job{}
+
+	for rows.Next() {
+		var job Job
+
+		err := rows.Scan(append([]any{&totalRecords}, jobDest(&job)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return jobs, metadata, nil
+}
+
+// Claim takes the next job which is due, marks it as running and counts an attempt. The job
+// is locked for the lease, if it is still running after that the worker is taken to have
+// died and the job can be claimed again. It returns nil if there is nothing to do. SKIP
+// LOCKED lets any number of workers (in any number of processes) claim jobs at once
+func (m JobModel) Claim(lease time.Duration) (*Job, error) {
+	query := fmt.Sprintf(`
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, locked_until = NOW() + make_interval(secs => $1)
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE (status = 'pending' AND run_at <= NOW()) OR (status = 'running' AND locked_until < NOW())
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING %s
+	`, jobColumns)
+
+	var job Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Seconds()).Scan(jobDest(&job)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// Succeed records that a job has finished
+func (m JobModel) Succeed(id int64) error {
+	query := `
+		UPDATE jobs
+		SET status = 'succeeded', locked_until = NULL, last_error = '', finished_at = NOW()
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Retry records a failed attempt and puts the job back in the queue to run after the delay
+func (m JobModel) Retry(id int64, message string, delay time.Duration) error {
+	query := `
+		UPDATE jobs
+		SET status = 'pending', locked_until = NULL, last_error = $2, run_at = NOW() + make_interval(secs => $3)
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, message, delay.Seconds())
+	return err
+}
+
+// Bury records the last failed attempt of a job and moves it to the dead-letter state
+func (m JobModel) Bury(id int64, message string) error {
+	query := `
+		UPDATE jobs
+		SET status = 'dead', locked_until = NULL, last_error = $2, finished_at = NOW()
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, message)
+	return err
+}
+
+// Requeue puts a dead job back in the queue with a fresh set of attempts. It returns
+// ErrJobNotDead for a job in any other state, and ErrRecordNotFound if there is no such job
+func (m JobModel) Requeue(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE jobs
+		SET status = 'pending', attempts = 0, run_at = NOW(), finished_at = NULL
+		WHERE id = $1 AND status = 'dead'
+		RETURNING %s
+	`, jobColumns)
+
+	var job Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(jobDest(&job)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// tell a job that isn't dead apart from one that doesn't exist
+			_, err = m.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrJobNotDead
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
@@ -16,14 +16,42 @@ var (
 // Create a models struct that wraps the MovieModel.
 // We are going to keep adding to this like the UserModel and the PermissionsModel
 type Models struct {
-	Movies MovieModel
-	Users  UserModel
+	Movies       MovieModel
+	Users        UserModel
+	Schema       SchemaModel
+	People       PersonModel
+	Credits      CreditModel
+	Tokens       TokenModel
+	Reviews      ReviewModel
+	Watchlist    WatchlistModel
+	History      HistoryModel
+	Permissions  PermissionModel
+	Genres       GenreModel
+	Artwork      ArtworkModel
+	Translations TranslationModel
+	Webhooks     WebhookModel
+	Jobs         JobModel
+	Suppressions SuppressionModel
 }
 
 // New() is responsible for initializing all the models
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
-		Users:  UserModel{DB: db},
+		Movies:       MovieModel{DB: db},
+		Users:        UserModel{DB: db},
+		Schema:       SchemaModel{DB: db},
+		People:       PersonModel{DB: db},
+		Credits:      CreditModel{DB: db},
+		Tokens:       TokenModel{DB: db},
+		Reviews:      ReviewModel{DB: db},
+		Watchlist:    WatchlistModel{DB: db},
+		History:      HistoryModel{DB: db},
+		Permissions:  PermissionModel{DB: db},
+		Genres:       GenreModel{DB: db},
+		Artwork:      ArtworkModel{DB: db},
+		Translations: TranslationModel{DB: db},
+		Webhooks:     WebhookModel{DB: db},
+		Jobs:         JobModel{DB: db},
+		Suppressions: SuppressionModel{DB: db},
 	}
 }
@@ -5,24 +5,95 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/lib/pq"
 	"greenlight.usman.com/internal/validator"
 )
 
+var (
+	ErrDuplicateImdbID = errors.New("duplicate imdb id")
+	ErrDuplicateTmdbID = errors.New("duplicate tmdb id")
+)
+
 type Movie struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	// Title and Synopsis are in the language the movie was read in, see GetFields()
+	Title    string   `json:"title"`
+	Synopsis string   `json:"synopsis,omitempty"`
+	Year     int32    `json:"year,omitempty"`
+	Runtime  Runtime  `json:"runtime,omitempty"`
+	Genres   []string `json:"genres,omitempty"`
+	// ContentRating is the classification given by the ContentRatingSystem, eg PG-13 by
+	// the MPAA. Both are empty when the movie hasn't been classified
+	ContentRatingSystem string       `json:"content_rating_system,omitempty"`
+	ContentRating       string       `json:"content_rating,omitempty"`
+	ReleaseDates        ReleaseDates `json:"release_dates,omitempty"`
+	// OriginalLanguage is the ISO 639-1 code of the language the movie was made in
+	OriginalLanguage string `json:"original_language,omitempty"`
+	// the IDs of the movie on IMDb and TMDB, they are unique when set
+	ImdbID string `json:"imdb_id,omitempty"`
+	TmdbID int64  `json:"tmdb_id,omitempty"`
+	// Rating is the aggregate of the users' reviews, kept up to date by the ReviewModel
+	Rating  MovieRating `json:"rating"`
+	Version int32       `json:"version"`
+	// Poster and Backdrop map each size of the artwork to its URL, they are filled in by the
+	// handlers as the URLs depend on where the files are stored
+	Poster   Artwork `json:"poster,omitempty"`
+	Backdrop Artwork `json:"backdrop,omitempty"`
+	// Credits is only filled in when the client asks for it with include=credits
+	Credits []*Credit `json:"credits,omitempty"`
+	// fields is set when the movie was read with a sparse fieldset, only those
+	// fields are included in the JSON (see fieldsets.go)
+	fields []string
+	// runtimeFormat is how the runtime is written in the JSON, see FormatRuntime()
+	runtimeFormat RuntimeFormat
+	// language is the language the title was read in, see Language()
+	language string
+}
+
+// Language returns the language the movie's title was read in: the requested one if the
+// movie has been translated into it, otherwise its original language. It is empty when
+// the movie fell back to a title whose original language isn't known
+func (m *Movie) Language() string {
+	return m.language
+}
+
+// FormatRuntime sets the format the runtime is written in when the movie is encoded to JSON.
+// The runtime is stored as minutes, so this only changes how it is presented
+func (m *Movie) FormatRuntime(format RuntimeFormat) {
+	m.runtimeFormat = format
+}
+
+// MovieRating is the average of the review ratings for a movie and the number of reviews.
+// The average is 0 when the movie has no reviews
+type MovieRating struct {
+	Average float64 `json:"average"`
+	Count   int32   `json:"count"`
 }
 
-// We are going to use this generic function to validate the movie struct passed in the request
-func ValidateMovie(v *validator.Validator, movie *Movie) {
+// ContentRatings holds the ratings of each content rating system we accept: the MPAA's for the
+// US and the BBFC's for the UK
+var ContentRatings = map[string][]string{
+	"mpaa": {"G", "PG", "PG-13", "R", "NC-17"},
+	"bbfc": {"U", "PG", "12A", "12", "15", "18", "R18"},
+}
+
+var (
+	// LanguageRX matches an ISO 639-1 language code, eg en or fr
+	LanguageRX = regexp.MustCompile(`^[a-z]{2}$`)
+	// ImdbIDRX matches an IMDb title ID, eg tt0111161
+	ImdbIDRX = regexp.MustCompile(`^tt[0-9]{7,}$`)
+)
+
+// We are going to use this generic function to validate the movie struct passed in the request.
+// The genres are checked against the taxonomy, so they should already have been through
+// GenreTaxonomy.Canonicalise() to turn any aliases into slugs
+func ValidateMovie(v *validator.Validator, movie *Movie, genres GenreTaxonomy) {
 	// Use the check method to execute our validation checks. This will add the provided key
 	// and error messages to the errors map if the check does not evaluate to true.
 	// For example - in the first check we check if the title is not equal to an empty string
@@ -42,6 +113,46 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 	// we can use the unique helper to check all the genres are unqie
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	for _, genre := range movie.Genres {
+		v.Check(genres.Known(genre), "genres", "unknown genre "+genre)
+	}
+
+	v.Check(len(movie.Synopsis) <= 10_000, "synopsis", "must not be more than 10000 bytes long")
+
+	// the rest of the fields are optional, but must be valid when they are given. A content
+	// rating needs the system it comes from, as PG means different things to the MPAA and BBFC
+	if movie.ContentRatingSystem != "" || movie.ContentRating != "" {
+		ratings, ok := ContentRatings[movie.ContentRatingSystem]
+		v.Check(ok, "content_rating_system", "must be mpaa or bbfc")
+		if ok {
+			v.Check(validator.PermittedValue(movie.ContentRating, ratings...), "content_rating", "must be one of "+strings.Join(ratings, ", "))
+		}
+	}
+
+	ValidateReleaseDates(v, movie.ReleaseDates)
+
+	if movie.OriginalLanguage != "" {
+		v.Check(validator.Matches(movie.OriginalLanguage, LanguageRX), "original_language", "must be an ISO 639-1 code, eg en")
+	}
+
+	if movie.ImdbID != "" {
+		v.Check(validator.Matches(movie.ImdbID, ImdbIDRX), "imdb_id", "must be an IMDb title ID, eg tt0111161")
+	}
+
+	v.Check(movie.TmdbID >= 0, "tmdb_id", "must be a positive integer")
+}
+
+// uniqueMovieError maps a unique constraint violation on the external IDs to our own errors,
+// and returns any other error as it is
+func uniqueMovieError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "movies_imdb_id_key"`:
+		return ErrDuplicateImdbID
+	case err.Error() == `pq: duplicate key value violates unique constraint "movies_tmdb_id_key"`:
+		return ErrDuplicateTmdbID
+	default:
+		return err
+	}
 }
 
 // MovieModel struct type will encapsulate all the code for reading and writing movie data to and from DB
@@ -56,25 +167,62 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// Define a query to insert a new record in the movies table
 	// RETURNING is a postgres specific clause which can be used to return values from the
 	// row inserted, updated or deleted
+	// The external IDs are stored as NULL when they aren't set, so that the unique
+	// constraints only apply to movies which have them
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, synopsis, year, runtime, genres, content_rating_system, content_rating,
+			release_dates, original_language, imdb_id, tmdb_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, 0))
 		RETURNING id, created_at, version
 	`
 
 	// args is a slice contaning the values of the placeholders
 	// pq.Array() is an adapter function takes our []string slice and converts it to a pq.StringArray type
 	// we can also use this with bool, byte, int32, int64, float32 and float64 array types
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{
+		movie.Title,
+		movie.Synopsis,
+		movie.Year,
+		movie.Runtime,
+		pq.Array(movie.Genres),
+		movie.ContentRatingSystem,
+		movie.ContentRating,
+		movie.ReleaseDates,
+		movie.OriginalLanguage,
+		movie.ImdbID,
+		movie.TmdbID,
+	}
 
 	// create a context with a 3 second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+
+	// the movie.created event goes into the webhook outbox in the same transaction, so it
+	// can't be lost if we crash after the movie is saved
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			return err
+		}
+
+		return insertWebhookEvent(ctx, tx, EventMovieCreated, movie)
+	})
+	if err != nil {
+		return uniqueMovieError(err)
+	}
+
+	return nil
 }
 
-// Get returns a specific record from the move DB
+// Get returns a specific record from the move DB, with its original title
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.GetFields(id, "", nil)
+}
+
+// GetFields returns a specific record, only reading the given fields (or every field if
+// fields is empty). The title and synopsis are translated into the language if there is a
+// translation for it, an empty language always gives the original title
+func (m MovieModel) GetFields(id int64, language string, fields []string) (*Movie, error) {
 
 	// Postgres bigserial that we are using as movie ID starts auto-incrementing at 1 by default
 	// we can assume there will be not value less than that.
@@ -84,11 +232,13 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Define the SQL query for retrieving the movie data
 	// pg_sleep(8) this can used to set the pg driver to sleep for 8 seconds
-	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
-		FROM movies
+	columns, dest := movieSelect(fields)
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM movies %s
 		WHERE id = $1
-	`
+	`, columns, movieTranslationJoin)
 
 	var movie Movie
 
@@ -104,16 +254,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	defer cancel()
 
 	// Note: we need to scan the target for genres column using the adapter method pq.Array()
+	// movieSelect() takes care of that for us, and only returns the selected columns
 	// Update the QueryRow method to use the QueryRowContext method for handling timeouts
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id, language).Scan(dest(&movie)...)
 
 	// If there was no movie found, Scan() will return an sql.ErrNoRows error.
 	// we check for this error and return our custom ErrRecordFound error instead
@@ -134,17 +277,26 @@ func (m MovieModel) Update(movie *Movie) error {
 
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, synopsis = $2, year = $3, runtime = $4, genres = $5, content_rating_system = $6,
+			content_rating = $7, release_dates = $8, original_language = $9, imdb_id = NULLIF($10, ''),
+			tmdb_id = NULLIF($11, 0), version = version + 1
+		WHERE id = $12 AND version = $13
 		RETURNING version
 	`
 
 	// args slice to contain the values of the placeholder parameters
 	args := []any{
 		movie.Title,
+		movie.Synopsis,
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.ContentRatingSystem,
+		movie.ContentRating,
+		movie.ReleaseDates,
+		movie.OriginalLanguage,
+		movie.ImdbID,
+		movie.TmdbID,
 		movie.ID,
 		movie.Version,
 	}
@@ -153,7 +305,14 @@ func (m MovieModel) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+		if err != nil {
+			return err
+		}
+
+		return insertWebhookEvent(ctx, tx, EventMovieUpdated, movie)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -162,7 +321,7 @@ func (m MovieModel) Update(movie *Movie) error {
 			}
 		default:
 			{
-				return err
+				return uniqueMovieError(err)
 			}
 		}
 	}
@@ -181,41 +340,247 @@ func (m MovieModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Exec method returns an sql.Result object that contains information about how many rows were effected
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// Exec method returns an sql.Result object that contains information about how many rows were effected
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
 
-	// call the rowsAffected method to get the number of rows affected by the query
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+		// call the rowsAffected method to get the number of rows affected by the query
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		// the movie is gone, so the event only carries its ID
+		return insertWebhookEvent(ctx, tx, EventMovieDeleted, map[string]int64{"id": id})
+	})
+}
+
+// MovieFields is the registry of the movie fields that GET /v1/movies can sort and filter on.
+// The sort and filter safelists are generated from it
+var MovieFields = FieldRegistry{
+	"id":         {Column: "id", Sortable: true, Selectable: true, Filter: FilterInt, Operators: ComparisonOperators},
+	"title":      {Column: "title", Sortable: true, Selectable: true},
+	"synopsis":   {Selectable: true},
+	"year":       {Column: "year", Sortable: true, Selectable: true, Filter: FilterInt, Operators: ComparisonOperators},
+	"runtime":    {Column: "runtime", Sortable: true, Selectable: true, Filter: FilterRuntime, Operators: ComparisonOperators},
+	"created_at": {Column: "created_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"genres":     {Column: "genres", Selectable: true, Filter: FilterStringArray, Operators: ArrayOperators},
+	// the classification and original language are matched exactly, eg content_rating=PG-13
+	"content_rating_system": {Column: "content_rating_system", Selectable: true, Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"content_rating":        {Column: "content_rating", Selectable: true, Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"original_language":     {Column: "original_language", Selectable: true, Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"release_dates":         {Selectable: true},
+	// released_in=GB matches the movies with a release date in that country
+	"released_in": {
+		Filter:         FilterString,
+		Operators:      []FilterOperator{OpEq},
+		FilterTemplate: "release_dates ? %s",
+	},
+	// look a movie up by its external ID, eg imdb_id=tt0111161
+	"imdb_id": {Column: "imdb_id", Selectable: true, Filter: FilterString, Operators: []FilterOperator{OpEq}},
+	"tmdb_id": {Column: "tmdb_id", Selectable: true, Filter: FilterInt, Operators: []FilterOperator{OpEq}},
+	// rating sorts and filters on the average review rating, eg rating>=7.5&sort=-rating
+	"rating":  {Column: "rating_average", Sortable: true, Selectable: true, Filter: FilterFloat, Operators: ComparisonOperators},
+	"version": {Column: "version", Selectable: true},
+	// the artwork isn't a column of the movies table, but can still be picked with fields=
+	"poster":   {Selectable: true},
+	"backdrop": {Selectable: true},
+	// person=42 matches the movies that person is credited on, in any role
+	"person": {
+		Filter:         FilterInt,
+		Operators:      []FilterOperator{OpEq},
+		FilterTemplate: "id IN (SELECT movie_id FROM movie_credits WHERE person_id = %s)",
+	},
+}
+
+// MovieFilterSafelist holds the fields that GET /v1/movies can be filtered on
+var MovieFilterSafelist = MovieFields.FilterSafelist()
+
+// MovieSelectSafelist holds the fields that can be requested with fields=
+var MovieSelectSafelist = MovieFields.SelectSafelist()
+
+// MovieSortSafelist holds the sort keys for GET /v1/movies. relevance sorts by how well
+// the title search matched, best match first
+var MovieSortSafelist = MovieFields.SortSafelist("relevance")
+
+// SearchMode selects how the title parameter is matched in GetAll
+type SearchMode string
+
+const (
+	// SearchFullText matches whole words using the full-text index (the default)
+	SearchFullText SearchMode = "fulltext"
+	// SearchPrefix matches words starting with each search term, for type-ahead
+	SearchPrefix SearchMode = "prefix"
+	// SearchFuzzy uses pg_trgm similarity so that typos still match
+	SearchFuzzy SearchMode = "fuzzy"
+	// SearchAuto uses full-text search, and falls back to fuzzy matching if nothing matched
+	SearchAuto SearchMode = "auto"
+)
+
+// SearchModes is the safelist for the search_mode query parameter
+var SearchModes = []SearchMode{SearchFullText, SearchPrefix, SearchFuzzy, SearchAuto}
+
+// ValidateSearch checks the search mode, and that a relevance sort has something to rank against
+func ValidateSearch(v *validator.Validator, title string, mode SearchMode, filters Filters) {
+	v.Check(validator.PermittedValue(mode, SearchModes...), "search_mode", "must be one of fulltext, prefix, fuzzy or auto")
+	v.Check(!filters.hasSortKey("relevance") || title != "", "sort", "relevance can only be used when searching by title")
+}
+
+// searchClause returns the WHERE condition and the ranking expression used to match a title
+// search, along with the value to bind to the $1 placeholder. An empty title matches everything.
+// The original titles are always searched. With a language, the titles translated into it are
+// searched too, using the text search configuration for the language so that words are
+// stemmed the right way. The queries bind the language to $2 (see movieTranslationJoin)
+func searchClause(title, language string, mode SearchMode) (match, rank, arg string) {
+	config, translated := searchConfigs[language]
+
+	switch mode {
+	case SearchPrefix:
+		// build a tsquery like 'star:* & wa:*' from the sanitised search terms
+		match = "to_tsvector('simple', title) @@ to_tsquery('simple', $1)"
+		rank = "ts_rank(to_tsvector('simple', title), to_tsquery('simple', $1))"
+		arg = prefixQuery(title)
+
+		if translated {
+			match += fmt.Sprintf(" OR movies.id IN (SELECT movie_id FROM movie_translations WHERE language = $2 AND to_tsvector('%[1]s', title) @@ to_tsquery('%[1]s', $1))", config)
+			rank = fmt.Sprintf("GREATEST(%s, ts_rank(to_tsvector('%[2]s', translated_title), to_tsquery('%[2]s', $1)))", rank, config)
+		}
+	case SearchFuzzy:
+		// % is the pg_trgm similarity operator, it uses the movies_title_trgm_idx index
+		match = "title % $1"
+		rank = "similarity(title, $1)"
+		arg = title
+
+		if translated {
+			match += " OR movies.id IN (SELECT movie_id FROM movie_translations WHERE language = $2 AND title % $1)"
+			rank = "GREATEST(similarity(title, $1), similarity(translated_title, $1))"
+		}
+	default:
+		match = "to_tsvector('simple', title) @@ plainto_tsquery('simple', $1)"
+		rank = "ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', $1))"
+		arg = title
+
+		if translated {
+			match += fmt.Sprintf(" OR movies.id IN (SELECT movie_id FROM movie_translations WHERE language = $2 AND to_tsvector('%[1]s', title) @@ plainto_tsquery('%[1]s', $1))", config)
+			rank = fmt.Sprintf("GREATEST(%s, ts_rank(to_tsvector('%[2]s', translated_title), plainto_tsquery('%[2]s', $1)))", rank, config)
+		}
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	// GREATEST() ignores the NULL rank of a movie with no translation
+	return "(" + match + " OR $1 = '')", rank, arg
+}
+
+// prefixQuery turns free text into a to_tsquery() expression where every word is a prefix
+// match. Anything that isn't a letter or digit is dropped, so the result is always valid
+// tsquery syntax
+func prefixQuery(title string) string {
+	words := strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i, word := range words {
+		words[i] = strings.ToLower(word) + ":*"
 	}
 
-	return nil
+	return strings.Join(words, " & ")
 }
 
 // Add a GetAll function that returns all the movies based on the filter values provided
-func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// With SearchAuto, if the full-text search matches nothing at all we try again with fuzzy
+// matching. An empty page past the last one isn't "nothing", so the fallback doesn't kick in
+// The rest of the filters (genres, year ranges and so on) come from filters.Conditions.
+// The titles are translated into the language where there is a translation, and the search
+// and title sort use the translated titles as well as the original ones
+func (m *MovieModel) GetAll(title, language string, mode SearchMode, filters Filters) ([]*Movie, Metadata, error) {
+	if mode != SearchAuto {
+		return m.getAll(title, language, mode, filters)
+	}
+
+	movies, metadata, err := m.getAll(title, language, SearchFullText, filters)
+	if err != nil || len(movies) > 0 || title == "" {
+		return movies, metadata, err
+	}
+
+	// an empty page after the first can just be past the end of the results, the window count
+	// is lost along with the rows so we have to count the matches to tell
+	if filters.Page > 1 {
+		total, err := m.count(title, language, SearchFullText, filters)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		if total > 0 {
+			return movies, calculateMetadata(total, filters.Page, filters.PageSize), nil
+		}
+	}
+
+	return m.getAll(title, language, SearchFuzzy, filters)
+}
+
+// count returns the number of movies matching the title search and the filters
+func (m *MovieModel) count(title, language string, mode SearchMode, filters Filters) (int, error) {
+	match, _, search := searchClause(title, language, mode)
+
+	conditions, args := filters.conditionSQL([]any{search, language})
+
 	query := fmt.Sprintf(`
-        SELECT count(*) over(), id, created_at, title, year, runtime, genres, version
-        FROM movies
-        WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
-        AND (genres @> $2 OR $2 = '{}')     
-        ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4
-		`, filters.sortColumn(), filters.sortDirection())
+        SELECT count(*)
+        FROM movies %s
+        WHERE %s %s
+		`, movieTranslationJoin, match, conditions)
 
-	// Create a local context to timeout after if the query does not respond in time
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	var total int
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (m *MovieModel) getAll(title, language string, mode SearchMode, filters Filters) ([]*Movie, Metadata, error) {
+	match, rank, search := searchClause(title, language, mode)
+
+	// the title search is always $1 and the language $2, the filter conditions follow them
+	conditions, args := filters.conditionSQL([]any{search, language})
+	args = append(args, filters.limit(), filters.offset())
+
+	// sorting by relevance orders by the rank of the title match, best first. The rating
+	// key isn't the name of its column, so it is mapped to the average here, and the title
+	// sorts on the translated title
+	orderBy := filters.orderBy(map[string]string{
+		"relevance": rank + " DESC",
+		"rating":    "rating_average ASC",
+		"-rating":   "rating_average DESC",
+		"title":     translatedTitleOrder["title"],
+		"-title":    translatedTitleOrder["-title"],
+	})
+
+	// only select the columns for the requested fields (all of them by default)
+	columns, dest := movieSelect(filters.Fields)
+
+	query := fmt.Sprintf(`
+        SELECT count(*) over(), %s
+        FROM movies %s
+        WHERE %s %s
+        ORDER BY %s
+		LIMIT $%d OFFSET $%d
+		`, columns, movieTranslationJoin, match, conditions, orderBy, len(args)-1, len(args))
+
+	// Create a local context to timeout after if the query does not respond in time
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -231,16 +596,7 @@ func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*
 	// Loop over the query result and scan the values in
 	for rows.Next() {
 		var movie Movie
-		err := rows.Scan(
-			&totalRecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		err := rows.Scan(append([]any{&totalRecords}, dest(&movie)...)...)
 
 		if err != nil {
 			return nil, Metadata{}, err
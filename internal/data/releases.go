@@ -0,0 +1,84 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+// ReleaseDates maps the ISO 3166-1 alpha-2 code of a country (US, GB, FR...) to the date the
+// movie was released there, as YYYY-MM-DD. It is kept in the release_dates jsonb column
+type ReleaseDates map[string]string
+
+// CountryRX matches an ISO 3166-1 alpha-2 country code. We don't check it is a country that
+// exists, only that it has the right form
+var CountryRX = regexp.MustCompile(`^[A-Z]{2}$`)
+
+func ValidateReleaseDates(v *validator.Validator, dates ReleaseDates) {
+	v.Check(len(dates) <= 250, "release_dates", "must not contain more than 250 countries")
+
+	for country, date := range dates {
+		v.Check(validator.Matches(country, CountryRX), "release_dates", "country "+country+" must be an ISO 3166-1 alpha-2 code, eg GB")
+
+		released, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			v.AddError("release_dates", "date for "+country+" must be in the form YYYY-MM-DD")
+			continue
+		}
+
+		v.Check(released.Year() >= 1888, "release_dates", "date for "+country+" must not be before 1888")
+	}
+}
+
+// Value stores the dates as a JSON object. Implementing driver.Valuer means a ReleaseDates
+// can be passed straight to Exec() and friends
+func (r ReleaseDates) Value() (driver.Value, error) {
+	if r == nil {
+		return "{}", nil
+	}
+
+	js, err := json.Marshal(map[string]string(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return string(js), nil
+}
+
+// Scan reads the dates back from the jsonb column, which the driver gives us as []byte
+func (r *ReleaseDates) Scan(src any) error {
+	var js []byte
+
+	switch src := src.(type) {
+	case []byte:
+		js = src
+	case string:
+		js = []byte(src)
+	case nil:
+		*r = nil
+		return nil
+	default:
+		return errors.New("release dates: unsupported type")
+	}
+
+	dates := map[string]string{}
+
+	err := json.Unmarshal(js, &dates)
+	if err != nil {
+		return err
+	}
+
+	// an empty object is read back as nil, so it is left out of the JSON like the other
+	// optional fields
+	if len(dates) == 0 {
+		*r = nil
+		return nil
+	}
+
+	*r = dates
+	return nil
+}
@@ -0,0 +1,318 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+var ErrDuplicateReview = errors.New("duplicate review")
+
+// Review is a user's rating of a movie from 1 to 10, with an optional written review.
+// Each user can only review a movie once
+type Review struct {
+	UserID    int64     `json:"user_id"`
+	MovieID   int64     `json:"movie_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Rating    int16     `json:"rating"`
+	Body      string    `json:"body,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+// ReviewFields is the registry of the fields the review listings can sort and filter on
+var ReviewFields = FieldRegistry{
+	"created_at": {Column: "created_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"rating":     {Column: "rating", Sortable: true, Filter: FilterInt, Operators: ComparisonOperators},
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating >= 1, "rating", "must be at least 1")
+	v.Check(review.Rating <= 10, "rating", "must not be more than 10")
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10000 bytes long")
+}
+
+// ReviewModel wraps the DB connection pool for the reviews table
+type ReviewModel struct {
+	DB *sql.DB
+}
+
+// lockMovie takes a row lock on the movie for the rest of the transaction. Every change to a
+// review locks its movie before touching the reviews table, so the changes to the reviews of
+// one movie are serialised. Without it, under READ COMMITTED two concurrent transactions
+// can't see each other's uncommitted review, and whichever commits last would write an
+// aggregate which is missing the other one. It returns ErrRecordNotFound if there is no movie
+func lockMovie(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	var id int64
+
+	err := tx.QueryRowContext(ctx, `SELECT id FROM movies WHERE id = $1 FOR UPDATE`, movieID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateMovieRating recalculates the average rating and the number of ratings for a movie.
+// It runs in the same transaction as the change to the review, after lockMovie(), so the
+// aggregate can never drift from the reviews: a concurrent change to the movie's reviews
+// waits for the lock, and its aggregate is read once this transaction has committed. The
+// movie version is not bumped, as a new review isn't an edit of the movie itself.
+func updateMovieRating(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	query := `
+		UPDATE movies
+		SET (rating_average, rating_count) = (
+			SELECT COALESCE(avg(rating), 0), count(*) FROM reviews WHERE movie_id = $1
+		)
+		WHERE id = $1
+	`
+
+	_, err := tx.ExecContext(ctx, query, movieID)
+	return err
+}
+
+// inTx runs fn in a transaction, committing if it returns nil and rolling back otherwise
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Insert adds a review and updates the movie's rating. It returns ErrDuplicateReview if the
+// user has already reviewed the movie, and ErrRecordNotFound if the movie doesn't exist
+func (m ReviewModel) Insert(review *Review) error {
+	query := `
+		INSERT INTO reviews (user_id, movie_id, rating, body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at, updated_at, version
+	`
+
+	args := []any{review.UserID, review.MovieID, review.Rating, review.Body}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockMovie(ctx, tx, review.MovieID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&review.CreatedAt, &review.UpdatedAt, &review.Version)
+		if err != nil {
+			return err
+		}
+
+		return updateMovieRating(ctx, tx, review.MovieID)
+	})
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_pkey"`:
+			return ErrDuplicateReview
+		case err.Error() == `pq: insert or update on table "reviews" violates foreign key constraint "reviews_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns the user's review of a movie
+func (m ReviewModel) Get(userID, movieID int64) (*Review, error) {
+	if userID < 1 || movieID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT user_id, movie_id, created_at, updated_at, rating, body, version
+		FROM reviews
+		WHERE user_id = $1 AND movie_id = $2
+	`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, movieID).Scan(
+		&review.UserID,
+		&review.MovieID,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.Rating,
+		&review.Body,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// Update changes a review and updates the movie's rating, using the version number for
+// optimistic locking
+func (m ReviewModel) Update(review *Review) error {
+	query := `
+		UPDATE reviews
+		SET rating = $1, body = $2, updated_at = NOW(), version = version + 1
+		WHERE user_id = $3 AND movie_id = $4 AND version = $5
+		RETURNING updated_at, version
+	`
+
+	args := []any{review.Rating, review.Body, review.UserID, review.MovieID, review.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockMovie(ctx, tx, review.MovieID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+		if err != nil {
+			return err
+		}
+
+		return updateMovieRating(ctx, tx, review.MovieID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the user's review of a movie and updates the movie's rating
+func (m ReviewModel) Delete(userID, movieID int64) error {
+	if userID < 1 || movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM reviews WHERE user_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockMovie(ctx, tx, movieID)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, query, userID, movieID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return updateMovieRating(ctx, tx, movieID)
+	})
+}
+
+// GetAllForMovie returns a page of the reviews of a movie
+func (m ReviewModel) GetAllForMovie(movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	return m.getAll("movie_id", movieID, filters)
+}
+
+// GetAllForUser returns a page of the reviews written by a user
+func (m ReviewModel) GetAllForUser(userID int64, filters Filters) ([]*Review, Metadata, error) {
+	return m.getAll("user_id", userID, filters)
+}
+
+// getAll returns the reviews where column (one of our own constants, never client input)
+// equals id, with the same pagination, sorting and filters as the other listings
+func (m ReviewModel) getAll(column string, id int64, filters Filters) ([]*Review, Metadata, error) {
+	conditions, args := filters.conditionSQL([]any{id})
+	args = append(args, filters.limit(), filters.offset())
+
+	query := fmt.Sprintf(`
+		SELECT count(*) over(), user_id, movie_id, created_at, updated_at, rating, body, version
+		FROM reviews
+		WHERE %s = $1 %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, column, conditions, filters.orderBy(nil), len(args)-1, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.UserID,
+			&review.MovieID,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Rating,
+			&review.Body,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reviews, metadata, nil
+}
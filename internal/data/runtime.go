@@ -1,16 +1,129 @@
 package data
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
+
+	"greenlight.usman.com/internal/validator"
 )
 
 type Runtime int32
 
 var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 
+// RuntimeFormat is how a runtime is written out, picked by the client with the
+// runtime_format query parameter or a Prefer header
+type RuntimeFormat string
+
+const (
+	// RuntimeMins is "142 mins", the original format and the default
+	RuntimeMins RuntimeFormat = "mins"
+	// RuntimeHoursMinutes is "2h 22m"
+	RuntimeHoursMinutes RuntimeFormat = "hours-minutes"
+	// RuntimeISO8601 is an ISO 8601 duration, "PT2H22M"
+	RuntimeISO8601 RuntimeFormat = "iso8601"
+	// RuntimeInteger is the number of minutes as a JSON number, 142
+	RuntimeInteger RuntimeFormat = "integer"
+)
+
+// RuntimeFormats is the safelist for the runtime_format parameter
+var RuntimeFormats = []RuntimeFormat{RuntimeMins, RuntimeHoursMinutes, RuntimeISO8601, RuntimeInteger}
+
+var (
+	// minutesRX matches a plain number of minutes, "142"
+	minutesRX = regexp.MustCompile(`^-?[0-9]+$`)
+	// hoursMinutesRX matches hours and/or minutes with units, "142 mins", "142 min", "2h 22m",
+	// "2 hours 22 minutes" or "2h"
+	hoursMinutesRX = regexp.MustCompile(`^(?:([0-9]+)\s*(?:h|hr|hrs|hour|hours))?\s*(?:([0-9]+)\s*(?:m|min|mins|minute|minutes))?$`)
+	// iso8601RX matches an ISO 8601 duration made of hours and minutes, "PT2H22M"
+	iso8601RX = regexp.MustCompile(`^pt(?:([0-9]+)h)?(?:([0-9]+)m)?$`)
+)
+
+// ParseRuntime reads a runtime in any of the forms we accept: a number of minutes ("142"),
+// minutes with a unit ("142 mins", "142 min"), hours and minutes ("2h 22m") or an ISO 8601
+// duration ("PT2H22M"). Units are case insensitive
+func ParseRuntime(s string) (Runtime, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if minutesRX.MatchString(s) {
+		return runtimeFromParts("", s)
+	}
+
+	for _, rx := range []*regexp.Regexp{hoursMinutesRX, iso8601RX} {
+		parts := rx.FindStringSubmatch(s)
+
+		// both parts are optional in the expressions, but one of them has to be there
+		if parts != nil && (parts[1] != "" || parts[2] != "") {
+			return runtimeFromParts(parts[1], parts[2])
+		}
+	}
+
+	return 0, ErrInvalidRuntimeFormat
+}
+
+// runtimeFromParts adds up the hours and minutes, either of which may be empty
+func runtimeFromParts(hours, minutes string) (Runtime, error) {
+	var total int64
+
+	if hours != "" {
+		h, err := strconv.ParseInt(hours, 10, 32)
+		if err != nil {
+			return 0, ErrInvalidRuntimeFormat
+		}
+		total += h * 60
+	}
+
+	if minutes != "" {
+		m, err := strconv.ParseInt(minutes, 10, 32)
+		if err != nil {
+			return 0, ErrInvalidRuntimeFormat
+		}
+		total += m
+	}
+
+	if total > math.MaxInt32 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	return Runtime(total), nil
+}
+
+// Format returns the runtime in the format, as a value to be encoded to JSON. The integer
+// format gives a number, the others a string. An unknown format is treated as RuntimeMins
+func (r Runtime) Format(format RuntimeFormat) any {
+	hours, minutes := r/60, r%60
+
+	switch format {
+	case RuntimeInteger:
+		return int32(r)
+	case RuntimeHoursMinutes:
+		switch {
+		case hours == 0:
+			return fmt.Sprintf("%dm", minutes)
+		case minutes == 0:
+			return fmt.Sprintf("%dh", hours)
+		default:
+			return fmt.Sprintf("%dh %dm", hours, minutes)
+		}
+	case RuntimeISO8601:
+		switch {
+		case hours == 0:
+			return fmt.Sprintf("PT%dM", minutes)
+		case minutes == 0:
+			return fmt.Sprintf("PT%dH", hours)
+		default:
+			return fmt.Sprintf("PT%dH%dM", hours, minutes)
+		}
+	default:
+		return fmt.Sprintf("%d mins", r)
+	}
+}
+
 // Implement the MarshalJSON method on the runtime type
 // so that it satisfies the json.Marshal interface
 func (r Runtime) MarshalJSON() ([]byte, error) {
@@ -29,24 +142,34 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 // Because JSON.UnmarshalJSON() needs to modify the receiver, we must use a pointer for this to work properly.
 // Otherwise we will only be modifying the copy
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// we know that the incoming value will be of the type "<runtime> mins"
-	// first we need to remove the quotes. If we can't unquote it we return ErrInvalidRuntimeFormat
-	unqotedJSONValue, err := strconv.Unquote(string(jsonValue))
-	if err != nil {
-		return ErrInvalidRuntimeFormat
+	// a JSON number is taken as the number of minutes, eg 142
+	var minutes json.Number
+	if json.Unmarshal(jsonValue, &minutes) == nil {
+		i, err := strconv.ParseInt(minutes.String(), 10, 32)
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
+
+		*r = Runtime(i)
+		return nil
 	}
 
-	// split the string to isolate the part containing the number
-	parts := strings.Split(unqotedJSONValue, " ")
-	if len(parts) != 2 || parts[1] != "mins" {
+	// otherwise it has to be a string in one of the forms ParseRuntime() accepts. If we can't
+	// unquote it we return ErrInvalidRuntimeFormat
+	unqotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
 		return ErrInvalidRuntimeFormat
 	}
 
-	i, err := strconv.ParseInt(parts[0], 10, 32)
+	runtime, err := ParseRuntime(unqotedJSONValue)
 	if err != nil {
-		return ErrInvalidRuntimeFormat
+		return err
 	}
 
-	*r = Runtime(i)
+	*r = runtime
 	return nil
 }
+
+func ValidateRuntimeFormat(v *validator.Validator, format RuntimeFormat) {
+	v.Check(validator.PermittedValue(format, RuntimeFormats...), "runtime_format", "must be one of mins, hours-minutes, iso8601 or integer")
+}
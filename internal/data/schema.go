@@ -0,0 +1,42 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// SchemaModel reads the migration state recorded by the migrate tool in the
+// schema_migrations table
+type SchemaModel struct {
+	DB *sql.DB
+}
+
+// Version returns the currently applied migration version and whether the last migration
+// failed part way through (dirty). If no migrations have been applied yet it returns 0.
+func (m SchemaModel) Version(ctx context.Context) (int64, bool, error) {
+	query := `SELECT version, dirty FROM schema_migrations LIMIT 1`
+
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		// 42P01 is undefined_table, ie migrate has never been run against this DB
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01":
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+// Suggestion is a single type-ahead match, along with how many movies it appears on. For a
+// genre the value is its display name, and Slug is what to filter the movies on
+type Suggestion struct {
+	Value string `json:"value"`
+	Slug  string `json:"slug,omitempty"`
+	Count int    `json:"count"`
+}
+
+// SuggestFields is the safelist for the field query parameter of the suggest endpoint
+var SuggestFields = []string{"title", "genre"}
+
+func ValidateSuggest(v *validator.Validator, q, field string, limit int) {
+	v.Check(strings.TrimSpace(q) != "", "q", "must be provided")
+	v.Check(len(q) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(validator.PermittedValue(field, SuggestFields...), "field", "must be title or genre")
+	v.Check(limit > 0, "limit", "must be greater than 0")
+	v.Check(limit <= 25, "limit", "must be a maximum of 25")
+}
+
+// Suggest returns up to limit distinct titles or genres matching q. Values starting with q
+// come first, then the closest trigram matches, so both type-ahead and small typos work.
+// Genres are matched on their name, slug and aliases, so "science" finds Science Fiction.
+// Unlike GetAll there is no window count, we only read the matching values.
+func (m MovieModel) Suggest(q, field string, limit int) ([]Suggestion, error) {
+	var query string
+
+	switch field {
+	case "genre":
+		// the genres table is small, so every genre is checked. The movies store the slugs,
+		// and are only read to count them, using the movies_genres_idx index
+		query = `
+			SELECT name, slug, (SELECT count(*) FROM movies WHERE movies.genres @> ARRAY[genres.slug]) AS movie_count
+			FROM genres, LATERAL (
+				SELECT
+					name ILIKE $2 OR slug ILIKE $2 OR EXISTS (
+						SELECT 1 FROM unnest(aliases) AS alias WHERE alias ILIKE $2
+					) AS prefix,
+					GREATEST(similarity(name, $1), similarity(slug, $1), (
+						SELECT max(similarity(alias, $1)) FROM unnest(aliases) AS alias
+					)) AS score
+			) AS match
+			WHERE prefix OR score >= show_limit()
+			ORDER BY prefix DESC, score DESC, movie_count DESC, name
+			LIMIT $3
+		`
+	default:
+		// the ILIKE and % conditions both use the movies_title_trgm_idx index
+		query = `
+			SELECT title, '', count(*)
+			FROM movies
+			WHERE title ILIKE $2 OR title % $1
+			GROUP BY title
+			ORDER BY title ILIKE $2 DESC, similarity(title, $1) DESC, count(*) DESC, title
+			LIMIT $3
+		`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{q, escapeLike(q) + "%", limit}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+
+	for rows.Next() {
+		var s Suggestion
+
+		err := rows.Scan(&s.Value, &s.Slug, &s.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		suggestions = append(suggestions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("suggest %s: %w", field, err)
+	}
+
+	return suggestions, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so that it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
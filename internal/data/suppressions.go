@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+// The reasons an address is suppressed
+const (
+	SuppressionBounce    = "bounce"
+	SuppressionComplaint = "complaint"
+	SuppressionManual    = "manual"
+)
+
+// Suppression is an email address we no longer send to. Sending to addresses which bounce
+// or complain again and again hurts our reputation with the mail providers
+type Suppression struct {
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+func ValidateSuppression(v *validator.Validator, suppression *Suppression) {
+	ValidateEmail(v, suppression.Email)
+
+	v.Check(validator.PermittedValue(suppression.Reason, SuppressionBounce, SuppressionComplaint, SuppressionManual), "reason", "must be bounce, complaint or manual")
+	v.Check(len(suppression.Detail) <= 1000, "detail", "must not be more than 1000 bytes long")
+}
+
+// SuppressionModel wraps the DB connection pool for the email_suppressions table
+type SuppressionModel struct {
+	DB *sql.DB
+}
+
+// Insert suppresses the address. If it is already suppressed the reason and detail are
+// replaced with the latest ones, the address is compared case insensitively
+func (m SuppressionModel) Insert(suppression *Suppression) error {
+	query := `
+		INSERT INTO email_suppressions (email, reason, detail)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (email) DO UPDATE SET reason = EXCLUDED.reason, detail = EXCLUDED.detail
+		RETURNING created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, suppression.Email, suppression.Reason, suppression.Detail).Scan(&suppression.CreatedAt)
+}
+
+// IsSuppressed reports whether the address is suppressed. It satisfies the
+// mailer.SuppressionList interface
+func (m SuppressionModel) IsSuppressed(email string) (bool, error) {
+	var suppressed bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM email_suppressions WHERE email = $1)`, email).Scan(&suppressed)
+	if err != nil {
+		return false, err
+	}
+
+	return suppressed, nil
+}
+
+// Delete lifts the suppression of an address
+func (m SuppressionModel) Delete(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM email_suppressions WHERE email = $1`, email)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+// Define constants for the token scopes. The scope lets us use the same tokens table
+// for different purposes
+const (
+	ScopeAuthentication = "authentication"
+	// ScopeActivation tokens are sent in the welcome email, and activate the account
+	ScopeActivation = "activation"
+	// ScopeEmailChange tokens are sent to the new address when a user changes their email,
+	// the change is only made once the token comes back
+	ScopeEmailChange = "email_change"
+	// ScopeEmailChangeCancel tokens are sent to the old address when a user changes their
+	// email, so that its owner can cancel a change they didn't ask for
+	ScopeEmailChangeCancel = "email_change_cancel"
+)
+
+// Token holds the data for an individual token. The plaintext is only ever sent to the
+// client, we only store the SHA-256 hash of it in the database
+type Token struct {
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"-"`
+	// Email is the pending email an email change (or cancel) token is for, it is empty for
+	// the other scopes
+	Email string `json:"-"`
+}
+
+func generateToken(userID int64, ttl time.Duration, scope string) *Token {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+		Scope:  scope,
+	}
+
+	// 16 random bytes (128 bits of entropy) from the operating system's CSPRNG, encoded
+	// as base32 without padding this gives a 26 character token
+	randomBytes := make([]byte, 16)
+	_, _ = rand.Read(randomBytes)
+
+	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token
+}
+
+// ValidateTokenPlaintext checks that the token is exactly 26 bytes long
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+}
+
+// TokenModel wraps the DB connection pool for the tokens table
+type TokenModel struct {
+	DB *sql.DB
+}
+
+// New creates a new token for the user and inserts it into the tokens table
+func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token := generateToken(userID, ttl, scope)
+
+	err := m.Insert(token)
+	return token, err
+}
+
+// NewForEmail creates a new email change or cancel token for the user, which only applies
+// while email is their pending email (see UserModel.ConfirmEmailChange())
+func (m TokenModel) NewForEmail(userID int64, ttl time.Duration, scope, email string) (*Token, error) {
+	token := generateToken(userID, ttl, scope)
+	token.Email = email
+
+	err := m.Insert(token)
+	return token, err
+}
+
+func (m TokenModel) Insert(token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, email)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// DeleteAllForUser deletes all the tokens for a user with the given scope
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"greenlight.usman.com/internal/validator"
+)
+
+// Languages are the languages the catalogue is translated into, one for each market we serve.
+// The migration's check constraint has to be kept in line with this list
+var Languages = []string{"en", "fr", "de", "es"}
+
+// DefaultLanguage is used when the client doesn't ask for any of the Languages
+const DefaultLanguage = "en"
+
+// searchConfigs maps each language to the Postgres text search configuration used for
+// full-text search on its translated titles, so that French titles are stemmed as French.
+// There is a partial index for each of them (see the movie_translations migration)
+var searchConfigs = map[string]string{
+	"en": "english",
+	"fr": "french",
+	"de": "german",
+	"es": "spanish",
+}
+
+// movieTranslationJoin joins the translation of each movie into the language bound to $2,
+// the queries using it put the language there. The columns are renamed so that they don't
+// clash with the movie's own title when they are referred to without a table name
+const movieTranslationJoin = `
+		LEFT JOIN LATERAL (
+			SELECT title AS translated_title, synopsis AS translated_synopsis, language AS translated_language
+			FROM movie_translations
+			WHERE movie_id = movies.id AND language = $2
+		) AS translation ON true`
+
+// translatedTitle is the title in the requested language, falling back to the original title
+// when the movie hasn't been translated into it
+const translatedTitle = "COALESCE(translated_title, title)"
+
+// servedLanguage is the language of translatedTitle, the movie's original language when it
+// falls back to the original title
+const servedLanguage = "COALESCE(translated_language, original_language)"
+
+// translatedSynopsis is the synopsis in the requested language. A translation can leave the
+// synopsis out, in which case the original one is used
+const translatedSynopsis = "COALESCE(NULLIF(translated_synopsis, ''), synopsis)"
+
+// translatedTitleOrder sorts on the translated title rather than the original one, it is
+// passed to orderBy() by the listings that use movieTranslationJoin
+var translatedTitleOrder = map[string]string{
+	"title":  translatedTitle + " ASC",
+	"-title": translatedTitle + " DESC",
+}
+
+// Translation is the title and synopsis of a movie in one of the Languages
+type Translation struct {
+	MovieID   int64     `json:"-"`
+	Language  string    `json:"language"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Title     string    `json:"title"`
+	Synopsis  string    `json:"synopsis,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateLanguage(v *validator.Validator, key, language string) {
+	v.Check(validator.PermittedValue(language, Languages...), key, "must be one of "+strings.Join(Languages, ", "))
+}
+
+func ValidateTranslation(v *validator.Validator, translation *Translation) {
+	ValidateLanguage(v, "language", translation.Language)
+
+	v.Check(translation.Title != "", "title", "must be provided")
+	v.Check(len(translation.Title) <= 500, "title", "must not be more than 500 bytes long")
+
+	v.Check(len(translation.Synopsis) <= 10_000, "synopsis", "must not be more than 10000 bytes long")
+}
+
+// TranslationModel wraps the DB connection pool for the movie_translations table
+type TranslationModel struct {
+	DB *sql.DB
+}
+
+// Put adds the translation, or replaces the movie's existing translation into the language.
+// It reports whether the translation is new, and returns ErrRecordNotFound if the movie
+// doesn't exist
+func (m TranslationModel) Put(translation *Translation) (bool, error) {
+	// xmax is only set on a row that was updated, so it tells us which branch was taken
+	query := `
+		INSERT INTO movie_translations (movie_id, language, title, synopsis)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (movie_id, language) DO UPDATE
+		SET title = EXCLUDED.title, synopsis = EXCLUDED.synopsis, updated_at = NOW(),
+			version = movie_translations.version + 1
+		RETURNING created_at, updated_at, version, xmax = 0
+	`
+
+	args := []any{translation.MovieID, translation.Language, translation.Title, translation.Synopsis}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var created bool
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&translation.CreatedAt,
+		&translation.UpdatedAt,
+		&translation.Version,
+		&created,
+	)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), `violates foreign key constraint "movie_translations_movie_id_fkey"`):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return created, nil
+}
+
+// GetAllForMovie returns every translation of the movie, ordered by language
+func (m TranslationModel) GetAllForMovie(movieID int64) ([]*Translation, error) {
+	query := `
+		SELECT movie_id, language, created_at, updated_at, title, synopsis, version
+		FROM movie_translations
+		WHERE movie_id = $1
+		ORDER BY language
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := []*Translation{}
+
+	for rows.Next() {
+		var t Translation
+
+		err := rows.Scan(&t.MovieID, &t.Language, &t.CreatedAt, &t.UpdatedAt, &t.Title, &t.Synopsis, &t.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		translations = append(translations, &t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return translations, nil
+}
+
+// Delete removes the movie's translation into the language
+func (m TranslationModel) Delete(movieID int64, language string) error {
+	query := `DELETE FROM movie_translations WHERE movie_id = $1 AND language = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, movieID, language)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -2,10 +2,12 @@ package data
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	"greenlight.usman.com/internal/validator"
 )
@@ -14,6 +16,9 @@ var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// AnonymousUser represents a request without a valid authentication token
+var AnonymousUser = &User{}
+
 type UserModel struct {
 	DB *sql.DB
 }
@@ -25,7 +30,17 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	// Language is the language the user's emails are sent in
+	Language string `json:"language"`
+	// PendingEmail is the address the user has asked to change to, it becomes the Email
+	// when the change is confirmed
+	PendingEmail string `json:"pending_email,omitempty"`
+	Version      int    `json:"-"`
+}
+
+// IsAnonymous checks if a user instance is the AnonymousUser
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
 }
 
 // contains the plaintext and hashed versions of the password for the user
@@ -93,6 +108,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
 
+	ValidateLanguage(v, "language", user.Language)
+
 	// If the plaintext password is not nil, call the standalone
 	// ValidatePasswordPlaintext() helper.
 	if user.Password.plaintext != nil {
@@ -111,10 +128,25 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // Insert is responsible for inserting a user in DB
 func (m UserModel) Insert(user *User) error {
+	return m.insert(user, nil)
+}
+
+// InsertWithJob adds the user and queues the job made by newJob in the same transaction, so
+// a user is never registered without it (or the other way round). newJob is called once the
+// user has its ID
+func (m UserModel) InsertWithJob(user *User, newJob func(*User) NewJob) error {
+	return m.insert(user, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := insertJob(ctx, tx, newJob(user))
+		return err
+	})
+}
+
+// insert adds the user, then runs then (if it isn't nil) in the same transaction
+func (m UserModel) insert(user *User, then func(ctx context.Context, tx *sql.Tx) error) error {
 
 	query := `
-        INSERT INTO users (name, email, password_hash, activated)
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO users (name, email, password_hash, activated, language)
+        VALUES ($1, $2, $3, $4, $5)
         RETURNING id, created_at, version
     `
 
@@ -123,16 +155,30 @@ func (m UserModel) Insert(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Language,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(
-		ctx,
-		query,
-		args...,
-	).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	// the user.registered event is written to the webhook outbox in the same transaction
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(
+			ctx,
+			query,
+			args...,
+		).Scan(&user.ID, &user.CreatedAt, &user.Version)
+		if err != nil {
+			return err
+		}
+
+		err = insertWebhookEvent(ctx, tx, EventUserRegistered, user)
+		if err != nil || then == nil {
+			return err
+		}
+
+		return then(ctx, tx)
+	})
 
 	if err != nil {
 		switch {
@@ -146,10 +192,50 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Get returns the user with the given ID
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, name, email, password_hash,
+        activated, language, pending_email, version FROM users WHERE id = $1
+    `
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Language,
+		&user.PendingEmail,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
         SELECT id, created_at, name, email, password_hash,
-        activated, version FROM users WHERE email = $1
+        activated, language, pending_email, version FROM users WHERE email = $1
     `
 
 	var user User
@@ -164,6 +250,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Language,
+		&user.PendingEmail,
 		&user.Version,
 	)
 
@@ -180,11 +268,21 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 func (m UserModel) Update(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		return updateUser(ctx, tx, user)
+	})
+}
+
+// updateUser saves the user as part of tx, using the version number for optimistic locking
+func updateUser(ctx context.Context, tx *sql.Tx, user *User) error {
 	query := `
         UPDATE users
         SET name=$1, email=$2, password_hash=$3,
-        activated=$4, version=version + 1
-        WHERE id = $5 AND version = $6
+        activated=$4, language=$5, pending_email=$6, version=version + 1
+        WHERE id = $7 AND version = $8
         RETURNING version
     `
 
@@ -193,14 +291,13 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Language,
+		user.PendingEmail,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -214,3 +311,162 @@ func (m UserModel) Update(user *User) error {
 
 	return nil
 }
+
+// RequestEmailChange saves the user, who has a new pending email, and queues the jobs which
+// send the confirmation and the notice. Any email change tokens sent for an earlier request
+// are deleted, all in the same transaction, so the change is never saved without its emails
+// (or the other way round). Like Update() it returns ErrEditConflict and ErrDuplicateEmail
+func (m UserModel) RequestEmailChange(user *User, jobs ...NewJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := updateUser(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			_, err = insertJob(ctx, tx, job)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetForToken returns the user that the token belongs to, if the token has the given
+// scope and has not expired yet
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	// we only store the hash of the token, so hash the plaintext before looking it up
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash,
+        users.activated, users.language, users.pending_email, users.version
+        FROM users
+        INNER JOIN tokens ON users.id = tokens.user_id
+        WHERE tokens.hash = $1
+        AND tokens.scope = $2
+        AND tokens.expiry > $3
+    `
+
+	// tokenHash is an array, so we slice it to pass a []byte
+	args := []any{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Language,
+		&user.PendingEmail,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// ConfirmEmailChange swaps the user's pending email in for their email, if the token is a
+// current email change token for that address. The token and any others for the email change
+// (the cancel tokens included) are used up, and the user's authentication tokens are revoked.
+// It returns ErrRecordNotFound if the token is invalid or expired (or there is no pending
+// email), and ErrDuplicateEmail if someone else has taken the address in the meantime
+func (m UserModel) ConfirmEmailChange(tokenPlaintext string) (*User, error) {
+	return m.resolveEmailChange(tokenPlaintext, ScopeEmailChange,
+		"email = users.pending_email,", ScopeEmailChange, ScopeEmailChangeCancel, ScopeAuthentication)
+}
+
+// CancelEmailChange clears the user's pending email, if the token is a current cancel token
+// for that address. The old address only gets a cancel token when someone else may be using
+// the account, so every authentication token is revoked as well as the email change ones.
+// It returns ErrRecordNotFound if the token is invalid or expired (or there is no pending
+// email)
+func (m UserModel) CancelEmailChange(tokenPlaintext string) (*User, error) {
+	return m.resolveEmailChange(tokenPlaintext, ScopeEmailChangeCancel,
+		"", ScopeEmailChange, ScopeEmailChangeCancel, ScopeAuthentication)
+}
+
+// resolveEmailChange clears the pending email of the user the token (of the given scope) is
+// for, after making any other changes in set (a constant, ending with a comma), then deletes
+// the user's tokens with the revoke scopes
+func (m UserModel) resolveEmailChange(tokenPlaintext, scope, set string, revoke ...string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	// a single UPDATE, so the change can't race with another update of the user
+	query := `
+        UPDATE users
+        SET ` + set + ` pending_email = '', version = users.version + 1
+        FROM tokens
+        WHERE tokens.hash = $1
+        AND tokens.scope = $2
+        AND tokens.expiry > $3
+        AND users.id = tokens.user_id
+        AND users.pending_email <> ''
+        AND users.pending_email = tokens.email
+        RETURNING users.id, users.created_at, users.name, users.email, users.password_hash,
+        users.activated, users.language, users.pending_email, users.version
+    `
+
+	args := []any{tokenHash[:], scope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Language,
+			&user.PendingEmail,
+			&user.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = ANY($1) AND user_id = $2`, pq.Array(revoke), user.ID)
+		return err
+	})
+
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
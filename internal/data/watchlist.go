@@ -0,0 +1,229 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrDuplicateWatchlistEntry = errors.New("duplicate watchlist entry")
+
+// WatchlistEntry is a movie a user has saved to watch later. Position orders the watchlist,
+// it always runs from 1 to the number of entries with no gaps
+type WatchlistEntry struct {
+	MovieID  int64     `json:"movie_id"`
+	AddedAt  time.Time `json:"added_at"`
+	Position int       `json:"position"`
+	Movie    *Movie    `json:"movie,omitempty"`
+}
+
+// WatchlistFields is the registry of the fields the watchlist can be sorted and filtered on.
+// The movie fields come from the joined movies table
+var WatchlistFields = FieldRegistry{
+	"position": {Column: "position", Sortable: true},
+	"added_at": {Column: "added_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"title":    {Column: "title", Sortable: true},
+	"year":     {Column: "year", Sortable: true, Filter: FilterInt, Operators: ComparisonOperators},
+	"genres":   {Column: "genres", Filter: FilterStringArray, Operators: ArrayOperators},
+}
+
+// WatchlistModel wraps the DB connection pool for the watchlist table
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// lockUser takes a lock on the user's row for the rest of the transaction. The watchlist
+// positions are read and then shifted, so two changes to the same watchlist at once have to
+// take turns or they could hand out the same position. FOR NO KEY UPDATE doesn't block
+// inserts which reference the user.
+func lockUser(ctx context.Context, tx *sql.Tx, userID int64) error {
+	var id int64
+
+	err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR NO KEY UPDATE`, userID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+
+	return err
+}
+
+// Add puts a movie at the end of the user's watchlist. It returns ErrDuplicateWatchlistEntry
+// if the movie is already on it, and ErrRecordNotFound if the movie doesn't exist
+func (m WatchlistModel) Add(userID, movieID int64) (*WatchlistEntry, error) {
+	query := `
+		INSERT INTO watchlist (user_id, movie_id, position)
+		VALUES ($1, $2, (SELECT COALESCE(max(position), 0) + 1 FROM watchlist WHERE user_id = $1))
+		RETURNING added_at, position
+	`
+
+	entry := &WatchlistEntry{MovieID: movieID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockUser(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRowContext(ctx, query, userID, movieID).Scan(&entry.AddedAt, &entry.Position)
+	})
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlist_pkey"`:
+			return nil, ErrDuplicateWatchlistEntry
+		case err.Error() == `pq: insert or update on table "watchlist" violates foreign key constraint "watchlist_movie_id_fkey"`:
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// Move changes the position of a movie on the user's watchlist, shifting the movies in
+// between up or down by one. A position past the end moves the movie to the end. It returns
+// the position the movie ended up at
+func (m WatchlistModel) Move(userID, movieID int64, position int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockUser(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		var current, count int
+
+		query := `
+			SELECT position, (SELECT count(*) FROM watchlist WHERE user_id = $1)
+			FROM watchlist
+			WHERE user_id = $1 AND movie_id = $2
+		`
+
+		err = tx.QueryRowContext(ctx, query, userID, movieID).Scan(&current, &count)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+
+		position = max(1, min(position, count))
+		if position == current {
+			return nil
+		}
+
+		// moving up the list pushes the movies in between down, and the other way round
+		shift := `
+			UPDATE watchlist SET position = position + 1
+			WHERE user_id = $1 AND position >= $2 AND position < $3
+		`
+		if position > current {
+			shift = `
+				UPDATE watchlist SET position = position - 1
+				WHERE user_id = $1 AND position > $3 AND position <= $2
+			`
+		}
+
+		_, err = tx.ExecContext(ctx, shift, userID, position, current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE watchlist SET position = $1 WHERE user_id = $2 AND movie_id = $3`, position, userID, movieID)
+		return err
+	})
+
+	return position, err
+}
+
+// Remove takes a movie off the user's watchlist and closes the gap it leaves
+func (m WatchlistModel) Remove(userID, movieID int64) error {
+	if userID < 1 || movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockUser(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		var position int
+
+		query := `DELETE FROM watchlist WHERE user_id = $1 AND movie_id = $2 RETURNING position`
+
+		err = tx.QueryRowContext(ctx, query, userID, movieID).Scan(&position)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+
+		query = `UPDATE watchlist SET position = position - 1 WHERE user_id = $1 AND position > $2`
+
+		_, err = tx.ExecContext(ctx, query, userID, position)
+		return err
+	})
+}
+
+// GetAll returns a page of the user's watchlist with the movies embedded, using the same
+// pagination, sorting and filters as the other listings. Like GetAll() for movies the titles
+// are translated into the language
+func (m WatchlistModel) GetAll(userID int64, language string, filters Filters) ([]*WatchlistEntry, Metadata, error) {
+	conditions, args := filters.conditionSQL([]any{userID, language})
+	args = append(args, filters.limit(), filters.offset())
+
+	// the movie columns aren't qualified, none of them clash with the watchlist columns
+	columns, dest := movieSelect(nil)
+
+	query := fmt.Sprintf(`
+		SELECT count(*) over(), w.movie_id, w.added_at, w.position, %s
+		FROM watchlist w
+		INNER JOIN movies ON movies.id = w.movie_id %s
+		WHERE w.user_id = $1 %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, columns, movieTranslationJoin, conditions, filters.orderBy(translatedTitleOrder), len(args)-1, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*WatchlistEntry{}
+
+	for rows.Next() {
+		entry := WatchlistEntry{Movie: &Movie{}}
+
+		err := rows.Scan(append([]any{&totalRecords, &entry.MovieID, &entry.AddedAt, &entry.Position}, dest(entry.Movie)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return entries, metadata, nil
+}
@@ -0,0 +1,554 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.usman.com/internal/validator"
+)
+
+// The events a webhook can subscribe to
+const (
+	EventMovieCreated   = "movie.created"
+	EventMovieUpdated   = "movie.updated"
+	EventMovieDeleted   = "movie.deleted"
+	EventUserRegistered = "user.registered"
+)
+
+// WebhookEventTypes is the safelist for the events of a webhook
+var WebhookEventTypes = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted, EventUserRegistered}
+
+// The states of a delivery. A pending delivery is waiting for its next attempt, a failed one
+// has used up all of its attempts and is only sent again if it is replayed
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a subscription to some of the events. Each delivery is POSTed to the URL and
+// signed with the secret, which is only sent to the client when it is set
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// GenerateWebhookSecret returns a new random signing secret: 32 random bytes (256 bits) from
+// the operating system's CSPRNG, base32 encoded like the tokens, with a whsec_ prefix so that
+// it is easy to spot
+func GenerateWebhookSecret() string {
+	randomBytes := make([]byte, 32)
+	_, _ = rand.Read(randomBytes)
+
+	return "whsec_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2048, "url", "must not be more than 2048 bytes long")
+
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	v.Check(len(webhook.Events) > 0, "events", "must contain at least 1 event")
+	for _, event := range webhook.Events {
+		v.Check(validator.PermittedValue(event, WebhookEventTypes...), "events", "unknown event "+event)
+	}
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+
+	// the secret is empty when it isn't being changed, as it is never read back
+	if webhook.Secret != "" {
+		v.Check(len(webhook.Secret) >= 16, "secret", "must be at least 16 bytes long")
+		v.Check(len(webhook.Secret) <= 200, "secret", "must not be more than 200 bytes long")
+	}
+}
+
+// WebhookDelivery is an entry in the delivery log of a webhook: one event, how many times
+// we tried to send it and what happened the last time
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	WebhookID      int64      `json:"webhook_id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Status         string     `json:"status"`
+	Attempts       int32      `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// DeliveryFields is the registry of the fields the delivery log can sort and filter on
+var DeliveryFields = FieldRegistry{
+	"id":         {Column: "id", Sortable: true},
+	"created_at": {Column: "created_at", Sortable: true, Filter: FilterTime, Operators: ComparisonOperators},
+	"status":     {Column: "status", Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"event_type": {Column: "event_type", Filter: FilterString, Operators: []FilterOperator{OpEq, OpNe}},
+	"attempts":   {Column: "attempts", Sortable: true, Filter: FilterInt, Operators: ComparisonOperators},
+}
+
+// OutgoingDelivery is a delivery claimed by the dispatcher, with everything needed to send it
+type OutgoingDelivery struct {
+	ID             int64
+	WebhookID      int64
+	Attempts       int32
+	URL            string
+	Secret         string
+	EventID        int64
+	EventType      string
+	EventCreatedAt time.Time
+	Payload        json.RawMessage
+}
+
+// Body returns the JSON that is POSTed to the webhook. The event ID is the same every time
+// the event is sent, so receivers can use it to ignore a delivery they have already seen
+func (d *OutgoingDelivery) Body() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"id":         d.EventID,
+		"type":       d.EventType,
+		"created_at": d.EventCreatedAt,
+		"data":       d.Payload,
+	})
+}
+
+// insertWebhookEvent adds an event to the outbox. It has to be called in the same transaction
+// as the change the event describes, so the event is written if and only if the change is
+func insertWebhookEvent(ctx context.Context, tx *sql.Tx, eventType string, payload any) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_events (type, payload) VALUES ($1, $2)`, eventType, js)
+	return err
+}
+
+// WebhookModel wraps the DB connection pool for the webhooks, the outbox and the delivery log
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a webhook. The secret is stored as it is, we need it to sign the deliveries
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, events, secret, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+
+	args := []any{webhook.URL, pq.Array(webhook.Events), webhook.Secret, webhook.Active}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Get returns a webhook, without its secret
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, url, events, active, version
+		FROM webhooks
+		WHERE id = $1
+	`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// GetAll returns every webhook, without their secrets
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, events, active, version
+		FROM webhooks
+		ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Update changes a webhook, checking the version like the other models. The secret is only
+// changed when webhook.Secret is set, as Get() doesn't read it
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, secret = COALESCE(NULLIF($3, ''), secret), active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version
+	`
+
+	args := []any{
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Secret,
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a webhook along with its delivery log
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// deliveryColumns is the SELECT list for a WebhookDelivery. The type of the event is joined
+// on in a subquery, so that the column names in the sort and filters aren't ambiguous
+const deliveryColumns = `id, webhook_id, event_id, event_type, created_at, status, attempts,
+	CASE WHEN status = 'pending' THEN next_attempt_at END, last_attempt_at, response_status,
+	last_error, delivered_at`
+
+func deliveryDest(d *WebhookDelivery) []any {
+	return []any{
+		&d.ID,
+		&d.WebhookID,
+		&d.EventID,
+		&d.EventType,
+		&d.CreatedAt,
+		&d.Status,
+		&d.Attempts,
+		&d.NextAttemptAt,
+		&d.LastAttemptAt,
+		&d.ResponseStatus,
+		&d.LastError,
+		&d.DeliveredAt,
+	}
+}
+
+// GetDeliveries returns the delivery log of a webhook
+func (m WebhookModel) GetDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	conditions, args := filters.conditionSQL([]any{webhookID})
+	args = append(args, filters.limit(), filters.offset())
+
+	query := fmt.Sprintf(`
+		SELECT count(*) over(), %s
+		FROM (
+			SELECT d.*, e.type AS event_type
+			FROM webhook_deliveries d
+			INNER JOIN webhook_events e ON e.id = d.event_id
+		) deliveries
+		WHERE webhook_id = $1 %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, deliveryColumns, conditions, filters.orderBy(nil), len(args)-1, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(append([]any{&totalRecords}, deliveryDest(&delivery)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
+
+// Replay queues a delivery to be sent again straight away, whatever happened to it before.
+// The attempts start again from zero, so a failed delivery gets the full set of retries
+func (m WebhookModel) Replay(webhookID, deliveryID int64) (*WebhookDelivery, error) {
+	if webhookID < 1 || deliveryID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE webhook_deliveries d
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW(), delivered_at = NULL
+		FROM webhook_events e
+		WHERE d.id = $1 AND d.webhook_id = $2 AND e.id = d.event_id
+		RETURNING d.id, d.webhook_id, d.event_id, e.type, d.created_at, d.status, d.attempts,
+			d.next_attempt_at, d.last_attempt_at, d.response_status, d.last_error, d.delivered_at
+	`
+
+	var delivery WebhookDelivery
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, deliveryID, webhookID).Scan(deliveryDest(&delivery)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &delivery, nil
+}
+
+// FanOut takes up to limit events from the outbox and creates a delivery of each one for
+// every active webhook subscribed to it. The events are marked as dispatched in the same
+// statement. SKIP LOCKED means several instances of the API can do this at the same time
+// without handling the same event twice. It returns the number of events taken
+func (m WebhookModel) FanOut(limit int) (int64, error) {
+	query := `
+		WITH events AS (
+			SELECT id, type
+			FROM webhook_events
+			WHERE dispatched_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), deliveries AS (
+			INSERT INTO webhook_deliveries (webhook_id, event_id)
+			SELECT w.id, events.id
+			FROM events
+			INNER JOIN webhooks w ON w.active AND events.type = ANY(w.events)
+			ON CONFLICT (webhook_id, event_id) DO NOTHING
+		)
+		UPDATE webhook_events
+		SET dispatched_at = NOW()
+		WHERE id IN (SELECT id FROM events)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Claim takes up to limit deliveries which are due and counts an attempt for each of them.
+// Their next attempt is pushed back by the lease, so if we crash before recording the result
+// another dispatcher will pick them up once the lease has run out
+func (m WebhookModel) Claim(limit int, lease time.Duration) ([]*OutgoingDelivery, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, last_attempt_at = NOW(), next_attempt_at = NOW() + make_interval(secs => $2)
+			WHERE id IN (
+				SELECT id
+				FROM webhook_deliveries
+				WHERE status = 'pending' AND next_attempt_at <= NOW()
+				ORDER BY next_attempt_at, id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, webhook_id, event_id, attempts
+		)
+		SELECT claimed.id, claimed.webhook_id, claimed.attempts, w.url, w.secret, e.id, e.type, e.created_at, e.payload
+		FROM claimed
+		INNER JOIN webhooks w ON w.id = claimed.webhook_id
+		INNER JOIN webhook_events e ON e.id = claimed.event_id
+		ORDER BY claimed.id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*OutgoingDelivery{}
+
+	for rows.Next() {
+		var delivery OutgoingDelivery
+
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Attempts,
+			&delivery.URL,
+			&delivery.Secret,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.EventCreatedAt,
+			&delivery.Payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// MarkDelivered records a successful attempt
+func (m WebhookModel) MarkDelivered(id int64, responseStatus int) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'delivered', delivered_at = NOW(), response_status = $2, last_error = ''
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, responseStatus)
+	return err
+}
+
+// MarkRetry records a failed attempt and schedules the next one after the delay
+func (m WebhookModel) MarkRetry(id int64, responseStatus int, message string, delay time.Duration) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET response_status = $2, last_error = $3, next_attempt_at = NOW() + make_interval(secs => $4)
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, responseStatus, message, delay.Seconds())
+	return err
+}
+
+// MarkFailed records the last failed attempt of a delivery, which won't be tried again
+// unless it is replayed
+func (m WebhookModel) MarkFailed(id int64, responseStatus int, message string) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'failed', response_status = $2, last_error = $3
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, responseStatus, message)
+	return err
+}
@@ -0,0 +1,131 @@
+// Package images checks uploaded images and generates resized copies of them. Everything is
+// done in pure Go, so there is no dependency on libvips or ImageMagick being installed.
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+
+	// register the decoders for the formats we accept with image.Decode
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupportedType = errors.New("must be a JPEG, PNG, GIF or WebP image")
+	ErrTooManyPixels   = fmt.Errorf("must not be larger than %d by %d pixels, or %d megapixels in total", MaxDimension, MaxDimension, MaxPixels/1_000_000)
+)
+
+// MaxDimension is the largest width or height we accept, and MaxPixels the largest area.
+// Decoding allocates memory for every pixel (4 bytes each, 8 for 16-bit PNGs), so the
+// dimensions are checked from the header before the image is decoded. The area limit keeps a
+// single image under about 320MB even when both sides are within MaxDimension
+const (
+	MaxDimension = 8000
+	MaxPixels    = 40_000_000
+)
+
+// formats maps the sniffed content types we accept to a file extension
+var formats = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// Variant is one stored version of an image, either the original upload or a thumbnail
+type Variant struct {
+	Name        string
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+	Body        []byte
+}
+
+// Process checks that body is an image we accept, going by its content rather than anything
+// the client claims, and returns the original followed by a thumbnail for each of the widths
+// (named w185 and so on). Widths that aren't smaller than the original are skipped, we never
+// scale an image up. The thumbnails are JPEGs, with any transparency flattened onto white
+func Process(body []byte, widths []int) ([]Variant, error) {
+	contentType := http.DetectContentType(body)
+
+	ext, ok := formats[contentType]
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	if cfg.Width > MaxDimension || cfg.Height > MaxDimension || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	bounds := src.Bounds()
+
+	variants := []Variant{{
+		Name:        "original",
+		ContentType: contentType,
+		Ext:         ext,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Body:        body,
+	}}
+
+	for _, width := range widths {
+		if width >= bounds.Dx() {
+			continue
+		}
+
+		thumbnail, err := resize(src, width)
+		if err != nil {
+			return nil, err
+		}
+
+		variants = append(variants, thumbnail)
+	}
+
+	return variants, nil
+}
+
+// resize scales src to the width, keeping the aspect ratio, and encodes it as a JPEG
+func resize(src image.Image, width int) (Variant, error) {
+	bounds := src.Bounds()
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+
+	err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	if err != nil {
+		return Variant{}, err
+	}
+
+	return Variant{
+		Name:        fmt.Sprintf("w%d", width),
+		ContentType: "image/jpeg",
+		Ext:         "jpg",
+		Width:       width,
+		Height:      height,
+		Body:        buf.Bytes(),
+	}, nil
+}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// FileTransport writes each message to a .eml file in a directory instead of sending it. The
+// files can be opened with any mail client, which makes it handy for checking how the emails
+// look during development
+type FileTransport struct {
+	dir string
+	seq atomic.Int64
+}
+
+// NewFile returns a FileTransport writing to dir, which is created if it doesn't exist
+func NewFile(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+// Send writes the message to a temporary file and renames it into place, so a reader never
+// sees a half written message. The files are named after the time they were written, with
+// a sequence number in case two are written in the same instant
+func (t *FileTransport) Send(msg *mail.Message) error {
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102T150405.000000000"), t.seq.Add(1))
+
+	tmp, err := os.CreateTemp(t.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = msg.WriteTo(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(t.dir, name))
+}
+
+// Ping checks that the directory is still there
+func (t *FileTransport) Ping(ctx context.Context) error {
+	info, err := os.Stat(t.dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", t.dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// LogTransport writes the messages to the logger instead of sending them
+type LogTransport struct {
+	logger *slog.Logger
+}
+
+// NewLog returns a LogTransport writing to the logger at the info level
+func NewLog(logger *slog.Logger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+// Send logs the headers we care about and the whole message as it would have been sent
+func (t *LogTransport) Send(msg *mail.Message) error {
+	raw := new(bytes.Buffer)
+
+	_, err := msg.WriteTo(raw)
+	if err != nil {
+		return err
+	}
+
+	t.logger.Info("email",
+		"to", msg.GetHeader("To"),
+		"from", msg.GetHeader("From"),
+		"subject", msg.GetHeader("Subject"),
+		"message", raw.String(),
+	)
+
+	return nil
+}
+
+// Ping always succeeds, there is nothing to connect to
+func (t *LogTransport) Ping(ctx context.Context) error {
+	return nil
+}
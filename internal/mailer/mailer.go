@@ -2,13 +2,37 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"errors"
+	"fmt"
 	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	ttemplate "text/template"
 	"time"
 
 	"github.com/go-mail/mail/v2"
+	"golang.org/x/time/rate"
 )
 
+var (
+	// ErrSuppressed is returned by Send when the recipient is on the suppression list, nothing
+	// is sent to them
+	ErrSuppressed = errors.New("mailer: recipient is suppressed")
+	// ErrPermanent wraps a transport error which will not go away by trying again, eg the
+	// SMTP server rejecting the recipient with a 5xx reply. Send doesn't retry these
+	ErrPermanent = errors.New("mailer: permanent failure")
+)
+
+// SuppressionList tells the Mailer which addresses it must not send to, eg because mail to
+// them has bounced. data.SuppressionModel satisfies it
+type SuppressionList interface {
+	IsSuppressed(email string) (bool, error)
+}
+
 // we declare a new variable with the type embed.FS
 // (embedded file system). This has a comment directive in the
 // format //go:embed <path> which indicates to GO that we want
@@ -18,57 +42,203 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// define a mailer instace which contains a mail.Dialer instance
-// used to connect to an SMTP server  and the sender information
-// for your emails (the names and address you want the emails to be from)
+// DefaultLocale is the locale of the templates without a locale in their name, and the one
+// used when there is no variant of a template for the locale asked for
+const DefaultLocale = "en"
+
+// define a mailer instace which contains the Transport used to deliver the messages
+// (an SMTP server in production, see transport.go), the sender information
+// for your emails (the names and address you want the emails to be from) and the
+// parsed templates
 
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Transport
+	sender    string
+	templates map[templateKey]*emailTemplate
+	// retries is how many times a failed send is retried, waiting retryDelay in between
+	retries    int
+	retryDelay time.Duration
+	// suppressions is checked before sending, and limiter throttles the sends. Both are
+	// optional, see WithSuppressions() and WithRateLimit()
+	suppressions SuppressionList
+	limiter      *rate.Limiter
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given
-	// SMTP server settings. we also configure this to use a 5-second timeout when sending emails
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// templateKey identifies a variant of an email template, eg user_welcome.tmpl in fr
+type templateKey struct {
+	name   string
+	locale string
+}
 
-	// return mailer instance containing the dialer and sender information
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+// emailTemplate is an email template parsed along with the base layout. The subject and the
+// plain text body are rendered with text/template, so that nothing in them is HTML escaped,
+// and the HTML body with html/template
+type emailTemplate struct {
+	text *ttemplate.Template
+	html *template.Template
+}
+
+// Rendered is an email rendered from a template, ready to be sent
+type Rendered struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// New returns a Mailer sending with the transport. The templates are parsed here, once,
+// so a broken template stops the application from starting rather than failing a send
+func New(transport Transport, sender string) (Mailer, error) {
+	templates, err := parseTemplates()
+	if err != nil {
+		return Mailer{}, err
 	}
+
+	// return mailer instance containing the transport, sender information and templates
+	return Mailer{
+		transport:  transport,
+		sender:     sender,
+		templates:  templates,
+		retries:    3,
+		retryDelay: 500 * time.Millisecond,
+	}, nil
 }
 
-// define a Send() method on the Mailer type. This takes the recipients email address as
-// the first parameter, the name of the file containing the templates, and any dynamic data
-// for the templates as an any parameter
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	// ParseFS() method to parse the required file from the embedded file system
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// WithSuppressions returns a copy of the Mailer which doesn't send to the addresses on the
+// suppression list
+func (m Mailer) WithSuppressions(list SuppressionList) Mailer {
+	m.suppressions = list
+	return m
+}
+
+// WithRateLimit returns a copy of the Mailer which sends at most perSecond messages a second,
+// with bursts of up to burst messages. The limiter is shared by all the copies made from the
+// returned Mailer, so it is a global limit however many goroutines are sending. A send waits
+// for its turn rather than failing, so that a burst of registrations is spread out instead of
+// flooding the mail server
+func (m Mailer) WithRateLimit(perSecond float64, burst int) Mailer {
+	m.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	return m
+}
+
+// parseTemplates parses every email template in the templates directory with the base
+// layout. A template is named <name>.tmpl for the default locale and <name>.<locale>.tmpl
+// for the other locales, eg user_welcome.tmpl and user_welcome.fr.tmpl
+func parseTemplates() (map[templateKey]*emailTemplate, error) {
+	files, err := fs.Glob(templateFS, "templates/*.tmpl")
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	templates := make(map[templateKey]*emailTemplate, len(files))
+
+	for _, file := range files {
+		key := keyForFile(path.Base(file))
+
+		// the locale() function lets the layout use the locale, eg in <html lang="">
+		locale := func() string { return key.locale }
+
+		text, err := ttemplate.New("email").Funcs(ttemplate.FuncMap{"locale": locale}).
+			ParseFS(templateFS, "templates/layouts/*.tmpl", file)
+		if err != nil {
+			return nil, err
+		}
+
+		html, err := template.New("email").Funcs(template.FuncMap{"locale": locale}).
+			ParseFS(templateFS, "templates/layouts/*.tmpl", file)
+		if err != nil {
+			return nil, err
+		}
+
+		templates[key] = &emailTemplate{text: text, html: html}
+	}
+
+	return templates, nil
+}
+
+// keyForFile works out the template name and locale from the name of a template file
+func keyForFile(file string) templateKey {
+	base := strings.TrimSuffix(file, ".tmpl")
+
+	name, locale, found := strings.Cut(base, ".")
+	if !found {
+		return templateKey{name: file, locale: DefaultLocale}
+	}
+
+	return templateKey{name: name + ".tmpl", locale: locale}
+}
+
+// Templates returns the names of the email templates, eg user_welcome.tmpl
+func (m Mailer) Templates() []string {
+	names := []string{}
+
+	for key := range m.templates {
+		if key.locale == DefaultLocale {
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Render renders the template for the locale, falling back to the default locale if there
+// is no variant of the template for it
+func (m Mailer) Render(locale, templateFile string, data any) (*Rendered, error) {
+	tmpl, ok := m.templates[templateKey{name: templateFile, locale: locale}]
+	if !ok {
+		tmpl, ok = m.templates[templateKey{name: templateFile, locale: DefaultLocale}]
+	}
+	if !ok {
+		return nil, fmt.Errorf("mailer: unknown template %s", templateFile)
 	}
 
 	// execute the named template "subject", passing in the dynamic data and storing the result
 	// in a bytes.Buffer variable
 	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	err := tmpl.text.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// following the same pattern we execute the plainBody template and store
 	// the result in the plainBody variable
 	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	err = tmpl.text.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// and similarly the htmlBody template
 	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	err = tmpl.html.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rendered{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(plainBody.String()) + "\n",
+		HTML:    strings.TrimSpace(htmlBody.String()) + "\n",
+	}, nil
+}
+
+// define a Send() method on the Mailer type. This takes the recipients email address as
+// the first parameter, the locale of the recipient (eg fr), the name of the file containing
+// the templates, and any dynamic data for the templates as an any parameter. Waiting for the
+// rate limit and between the retries stops when ctx is done, eg when the job times out
+func (m Mailer) Send(ctx context.Context, recipient, locale, templateFile string, data any) error {
+	// don't send anything to an address which has bounced or complained
+	if m.suppressions != nil {
+		suppressed, err := m.suppressions.IsSuppressed(recipient)
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			return ErrSuppressed
+		}
+	}
+
+	rendered, err := m.Render(locale, templateFile, data)
 	if err != nil {
 		return err
 	}
@@ -80,24 +250,49 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	msg := mail.NewMessage()
 	msg.SetHeader("To", recipient)
 	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/plain", htmlBody.String())
+	msg.SetHeader("Subject", rendered.Subject)
+	msg.SetBody("text/plain", rendered.Text)
+	msg.AddAlternative("text/html", rendered.HTML)
+
+	// we can also try to add a retry function to the Send() functionality
+	for i := 0; i <= m.retries; i++ {
 
-	// we can also try to add a retry function to the DialAndSend() functionality
-	for i := 0; i <= 3; i++ {
+		// wait for our turn under the send rate limit, each attempt counts against it
+		if m.limiter != nil {
+			err = m.limiter.Wait(ctx)
+			if err != nil {
+				return err
+			}
+		}
 
-		// call the DialAndSend() method on the dialer, passing in the message to send.
-		// This opens a connection to SMTP server, sends the message, then closes the conncetion
-		// If there is a timeout, it will return a "dial tcp: i/o timeout" error
-		err = m.dialer.DialAndSend(msg)
+		// hand the message to the transport, for SMTP this opens a connection to the server,
+		// sends the message, then closes the connection
+		err = m.transport.Send(msg)
 		if err == nil {
 			return nil
 		}
 
-		// if this didnot work, sleep for a short time and retry
-		time.Sleep(500 * time.Millisecond)
+		// a permanent failure, eg the recipient doesn't exist, fails the same way every time
+		// and retrying it only hurts our reputation with the mail server
+		if errors.Is(err, ErrPermanent) {
+			return err
+		}
+
+		// if this didnot work, sleep for a short time and retry (but not after the last attempt)
+		if i < m.retries {
+			select {
+			case <-time.After(m.retryDelay):
+			case <-ctx.Done():
+				return fmt.Errorf("%w (after %w)", ctx.Err(), err)
+			}
+		}
 	}
 
 	return err
 }
+
+// Ping checks that the transport is able to send, eg that we can connect and authenticate
+// to the SMTP server, without sending anything
+func (m Mailer) Ping(ctx context.Context) error {
+	return m.transport.Ping(ctx)
+}
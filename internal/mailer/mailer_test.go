@@ -0,0 +1,172 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// welcomeData is enough for the user_welcome templates to render
+var welcomeData = map[string]any{"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "userID": 1}
+
+// newTestMailer returns a Mailer sending with the transport, without the delay between retries
+func newTestMailer(t *testing.T, transport Transport) Mailer {
+	t.Helper()
+
+	m, err := New(transport, "Greenlight <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.retryDelay = 0
+
+	return m
+}
+
+// countingTransport fails every send with err, counting the attempts
+type countingTransport struct {
+	err   error
+	sends int
+}
+
+func (t *countingTransport) Send(msg *mail.Message) error {
+	t.sends++
+	return t.err
+}
+
+func (t *countingTransport) Ping(ctx context.Context) error {
+	return nil
+}
+
+// suppressionList suppresses the addresses in it, or fails every lookup with err
+type suppressionList struct {
+	addresses []string
+	err       error
+}
+
+func (l suppressionList) IsSuppressed(email string) (bool, error) {
+	for _, address := range l.addresses {
+		if address == email {
+			return true, l.err
+		}
+	}
+
+	return false, l.err
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		wantErr  error
+		wantSent int
+	}{
+		{name: "first attempt", failures: 0, wantSent: 1},
+		{name: "after failures", failures: 2, wantSent: 1},
+		{name: "on the last retry", failures: 3, wantSent: 1},
+		{name: "out of retries", failures: 4, wantErr: ErrMemoryFailure, wantSent: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewMemory()
+			transport.FailNext(tt.failures)
+
+			err := newTestMailer(t, transport).Send(context.Background(), "alice@example.com", "en", "user_welcome.tmpl", welcomeData)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			messages := transport.Messages()
+			if len(messages) != tt.wantSent {
+				t.Fatalf("got %d messages sent, want %d", len(messages), tt.wantSent)
+			}
+			if tt.wantSent > 0 && messages[0].To[0] != "alice@example.com" {
+				t.Errorf("got recipient %q, want alice@example.com", messages[0].To[0])
+			}
+		})
+	}
+}
+
+func TestSendFailureKinds(t *testing.T) {
+	transient := errors.New("451 try again later")
+
+	tests := []struct {
+		name      string
+		err       error
+		wantSends int
+	}{
+		// the first attempt and the 3 retries
+		{name: "transient", err: transient, wantSends: 4},
+		{name: "permanent", err: fmt.Errorf("%w: 550 no such user", ErrPermanent), wantSends: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &countingTransport{err: tt.err}
+
+			err := newTestMailer(t, transport).Send(context.Background(), "alice@example.com", "en", "user_welcome.tmpl", welcomeData)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if transport.sends != tt.wantSends {
+				t.Errorf("got %d attempts, want %d", transport.sends, tt.wantSends)
+			}
+		})
+	}
+}
+
+func TestSendSuppressed(t *testing.T) {
+	transport := NewMemory()
+	m := newTestMailer(t, transport).WithSuppressions(suppressionList{addresses: []string{"bounced@example.com"}})
+
+	err := m.Send(context.Background(), "bounced@example.com", "en", "user_welcome.tmpl", welcomeData)
+	if !errors.Is(err, ErrSuppressed) {
+		t.Fatalf("got error %v, want ErrSuppressed", err)
+	}
+	if len(transport.Messages()) != 0 {
+		t.Fatal("a message was sent to a suppressed address")
+	}
+
+	err = m.Send(context.Background(), "alice@example.com", "en", "user_welcome.tmpl", welcomeData)
+	if err != nil {
+		t.Fatalf("got error %v sending to an address which isn't suppressed", err)
+	}
+	if len(transport.Messages()) != 1 {
+		t.Fatalf("got %d messages sent, want 1", len(transport.Messages()))
+	}
+}
+
+func TestSendSuppressionListError(t *testing.T) {
+	lookupErr := errors.New("database is down")
+	transport := NewMemory()
+	m := newTestMailer(t, transport).WithSuppressions(suppressionList{err: lookupErr})
+
+	err := m.Send(context.Background(), "alice@example.com", "en", "user_welcome.tmpl", welcomeData)
+	if !errors.Is(err, lookupErr) {
+		t.Fatalf("got error %v, want %v", err, lookupErr)
+	}
+	if len(transport.Messages()) != 0 {
+		t.Fatal("a message was sent without checking the suppression list")
+	}
+}
+
+func TestSendStopsWhenContextDone(t *testing.T) {
+	transport := &countingTransport{err: errors.New("451 try again later")}
+	m := newTestMailer(t, transport)
+	m.retryDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := m.Send(ctx, "alice@example.com", "en", "user_welcome.tmpl", welcomeData)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+	if transport.sends != 1 {
+		t.Errorf("got %d attempts, want 1", transport.sends)
+	}
+}
@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// ErrMemoryFailure is returned by MemoryTransport.Send for the failures set up with FailNext()
+var ErrMemoryFailure = errors.New("mailer: simulated failure")
+
+// Captured is a message kept by the MemoryTransport
+type Captured struct {
+	To      []string
+	From    string
+	Subject string
+	// Raw is the whole message as it would have been sent
+	Raw []byte
+}
+
+// MemoryTransport keeps the messages in memory so that tests can check what would have been
+// sent. FailNext() makes it fail, to test what happens when the mail server is down
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Captured
+	failures int
+}
+
+// NewMemory returns an empty MemoryTransport
+func NewMemory() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(msg *mail.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures > 0 {
+		t.failures--
+		return ErrMemoryFailure
+	}
+
+	raw := new(bytes.Buffer)
+
+	_, err := msg.WriteTo(raw)
+	if err != nil {
+		return err
+	}
+
+	captured := Captured{
+		To:  msg.GetHeader("To"),
+		Raw: raw.Bytes(),
+	}
+	if from := msg.GetHeader("From"); len(from) > 0 {
+		captured.From = from[0]
+	}
+	if subject := msg.GetHeader("Subject"); len(subject) > 0 {
+		captured.Subject = subject[0]
+	}
+
+	t.messages = append(t.messages, captured)
+
+	return nil
+}
+
+// Ping always succeeds
+func (t *MemoryTransport) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (t *MemoryTransport) Messages() []Captured {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Captured(nil), t.messages...)
+}
+
+// FailNext makes the next n calls to Send() fail with ErrMemoryFailure
+func (t *MemoryTransport) FailNext(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failures = n
+}
+
+// Reset forgets the messages and any failures still to come
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+	t.failures = 0
+}
@@ -0,0 +1,179 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"net/textproto"
+	"slices"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// Transport delivers a message once it has been built by the Mailer. The SMTP transport is
+// what we use in production, the others are for development and tests, where we don't want
+// to (or can't) talk to a real mail server
+type Transport interface {
+	// Send delivers the message. The Mailer retries it if this returns an error, unless the
+	// error wraps ErrPermanent
+	Send(msg *mail.Message) error
+	// Ping checks that the transport is able to send, without sending anything
+	Ping(ctx context.Context) error
+}
+
+// SMTPTransport sends the messages to an SMTP server
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+// NewSMTP returns an SMTPTransport for the server. We configure the dialer to use a 5-second
+// timeout when sending emails
+func NewSMTP(host string, port int, username, password string) *SMTPTransport {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+// smtpSession is the part of the connection returned by the dialer's Dial() that Send()
+// uses. go-mail's sender embeds the *smtp.Client, so these methods are promoted to it
+type smtpSession interface {
+	Mail(from string) error
+	Rcpt(to string) error
+	Data() (io.WriteCloser, error)
+}
+
+// Send opens a connection to the SMTP server, sends the message, then closes the connection.
+// If there is a timeout, it will return a "dial tcp: i/o timeout" error. We run the SMTP
+// transaction ourselves rather than calling DialAndSend(), so that we know which step failed:
+// only a 5xx reply to RCPT TO or DATA is a rejection of this message, and is wrapped with
+// ErrPermanent. Anything going wrong before that (connecting, a 535 to AUTH, or a rejected
+// MAIL FROM) is about our account or the server rather than the message, and is retried
+func (t *SMTPTransport) Send(msg *mail.Message) error {
+	conn, err := t.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session, ok := conn.(smtpSession)
+	if !ok {
+		// we can't tell the steps apart, so treat any failure as temporary
+		return mail.Send(conn, msg)
+	}
+
+	from, to, err := envelope(msg)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	err = session.Mail(from)
+	if err != nil {
+		return fmt.Errorf("MAIL FROM: %w", err)
+	}
+
+	for _, addr := range to {
+		err = session.Rcpt(addr)
+		if err != nil {
+			return rejected(fmt.Errorf("RCPT TO %s: %w", addr, err))
+		}
+	}
+
+	w, err := session.Data()
+	if err != nil {
+		return rejected(fmt.Errorf("DATA: %w", err))
+	}
+
+	_, err = msg.WriteTo(w)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	// the server replies to the whole message once it has been sent
+	err = w.Close()
+	if err != nil {
+		return rejected(fmt.Errorf("DATA: %w", err))
+	}
+
+	return nil
+}
+
+// rejected wraps err with ErrPermanent if it is a 5xx reply from the SMTP server, eg
+// "550 mailbox unavailable". 4xx replies are temporary and worth retrying, as are the
+// network errors
+func rejected(err error) error {
+	if isPermanentSMTPError(err) {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	return err
+}
+
+// isPermanentSMTPError reports whether err is a 5xx reply from the SMTP server
+func isPermanentSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500 && protoErr.Code <= 599
+	}
+
+	return false
+}
+
+// envelope returns the SMTP envelope of the message: the sender is the Sender header if
+// there is one, otherwise From, and the recipients are everyone in To, Cc and Bcc, once each
+func envelope(msg *mail.Message) (string, []string, error) {
+	from := msg.GetHeader("Sender")
+	if len(from) == 0 {
+		from = msg.GetHeader("From")
+	}
+	if len(from) == 0 {
+		return "", nil, errors.New("mailer: message has no From header")
+	}
+
+	sender, err := netmail.ParseAddress(from[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("mailer: invalid sender %q: %w", from[0], err)
+	}
+
+	to := []string{}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range msg.GetHeader(field) {
+			addr, err := netmail.ParseAddress(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("mailer: invalid recipient %q: %w", value, err)
+			}
+			if !slices.Contains(to, addr.Address) {
+				to = append(to, addr.Address)
+			}
+		}
+	}
+
+	return sender.Address, to, nil
+}
+
+// Ping checks that we can connect and authenticate to the SMTP server, without sending
+// anything. The dialer has no context support, so the dial runs in its own goroutine
+// and we stop waiting for it when the context is done.
+func (t *SMTPTransport) Ping(ctx context.Context) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		conn, err := t.dialer.Dial()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- conn.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+// Package storage stores uploaded files (the movie artwork) behind the BlobStore interface, so
+// the API doesn't care whether they end up on the local disk or in an S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidKey is returned for a key that could escape the store, eg one containing ".."
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// BlobStore stores blobs under slash separated keys, eg movies/1/poster/ab12-w185.jpg. The
+// blobs are small enough (a few MB at most) to be passed around as byte slices
+type BlobStore interface {
+	// Put stores the blob under the key, replacing anything already there
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+	// Delete removes the blob. Deleting a key that doesn't exist is not an error
+	Delete(ctx context.Context, key string) error
+	// URL returns the address clients can download the blob from
+	URL(key string) string
+}
+
+// validKey checks that a key is relative and has no empty, . or .. segments
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return false
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS movies_rating_average_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_count;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_average;
+DROP TABLE IF EXISTS reviews;
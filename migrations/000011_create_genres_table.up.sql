@@ -0,0 +1,61 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    slug text NOT NULL,
+    name text NOT NULL,
+    aliases text[] NOT NULL DEFAULT '{}',
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT genres_slug_key UNIQUE (slug),
+    CONSTRAINT genres_slug_check CHECK (slug ~ '^[a-z0-9]+(-[a-z0-9]+)*$')
+);
+
+-- unaccent transliterates the accented letters, so "Comédie" becomes comedie rather than com-die
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+-- The slug of a free-text genre: transliterated and lower case, with every run of other
+-- characters turned into a single hyphen, so "Sci-Fi", "sci fi" and " SCI-FI " all become
+-- sci-fi. This has to match data.Slugify()
+CREATE OR REPLACE FUNCTION pg_temp.genre_slug(genre text) RETURNS text AS $$
+    SELECT trim(BOTH '-' FROM regexp_replace(lower(unaccent(genre)), '[^a-z0-9]+', '-', 'g'))
+$$ LANGUAGE sql STABLE;
+
+-- A genre with letters or digits that can't be transliterated (eg written in Cyrillic) would
+-- lose them in its slug, and could lose the genre altogether. Rather than drop data, stop the
+-- migration and list the genres, so that they can be renamed before running it again
+DO $$
+DECLARE
+    untransliterable text;
+BEGIN
+    SELECT string_agg(DISTINCT genre, ', ') INTO untransliterable
+    FROM movies, unnest(genres) AS genre
+    WHERE regexp_replace(unaccent(genre), '[^[:alnum:]]+', '', 'g') ~ '[^\x01-\x7f]';
+
+    IF untransliterable IS NOT NULL THEN
+        RAISE EXCEPTION 'these movie genres cannot be turned into slugs, rename them first: %', untransliterable;
+    END IF;
+END
+$$;
+
+-- Backfill a genre for each distinct slug already used by a movie. The display name is the
+-- most common spelling of it
+INSERT INTO genres (slug, name)
+SELECT slug, mode() WITHIN GROUP (ORDER BY trim(genre))
+FROM (
+    SELECT genre, pg_temp.genre_slug(genre) AS slug
+    FROM movies, unnest(genres) AS genre
+) AS used
+WHERE slug <> ''
+GROUP BY slug
+ON CONFLICT (slug) DO NOTHING;
+
+-- Rewrite the movie genres as slugs, dropping any duplicates this creates but keeping the order
+UPDATE movies SET genres = ARRAY(
+    SELECT slug
+    FROM (
+        SELECT DISTINCT ON (pg_temp.genre_slug(genre)) pg_temp.genre_slug(genre) AS slug, position
+        FROM unnest(movies.genres) WITH ORDINALITY AS g(genre, position)
+        WHERE pg_temp.genre_slug(genre) <> ''
+        ORDER BY pg_temp.genre_slug(genre), position
+    ) AS canonical
+    ORDER BY position
+);
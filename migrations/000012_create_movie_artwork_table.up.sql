@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS movie_artwork (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    kind text NOT NULL,
+    variant text NOT NULL,
+    key text NOT NULL,
+    content_type text NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (movie_id, kind, variant),
+    CONSTRAINT movie_artwork_kind_check CHECK (kind IN ('poster', 'backdrop'))
+);
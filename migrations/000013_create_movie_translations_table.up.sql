@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS movie_translations (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    language text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    title text NOT NULL,
+    synopsis text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1,
+    PRIMARY KEY (movie_id, language),
+    CONSTRAINT movie_translations_language_check CHECK (language IN ('en', 'fr', 'de', 'es'))
+);
+
+-- Translated titles are searched with the text search configuration of their language, so
+-- each language gets its own full-text index. These have to match data.searchConfigs
+CREATE INDEX IF NOT EXISTS movie_translations_title_en_idx ON movie_translations USING GIN (to_tsvector('english', title)) WHERE language = 'en';
+CREATE INDEX IF NOT EXISTS movie_translations_title_fr_idx ON movie_translations USING GIN (to_tsvector('french', title)) WHERE language = 'fr';
+CREATE INDEX IF NOT EXISTS movie_translations_title_de_idx ON movie_translations USING GIN (to_tsvector('german', title)) WHERE language = 'de';
+CREATE INDEX IF NOT EXISTS movie_translations_title_es_idx ON movie_translations USING GIN (to_tsvector('spanish', title)) WHERE language = 'es';
+CREATE INDEX IF NOT EXISTS movie_translations_title_trgm_idx ON movie_translations USING GIN (title gin_trgm_ops);
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS movies_release_dates_idx;
+DROP INDEX IF EXISTS movies_content_rating_idx;
+DROP INDEX IF EXISTS movies_original_language_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS tmdb_id;
+ALTER TABLE movies DROP COLUMN IF EXISTS imdb_id;
+ALTER TABLE movies DROP COLUMN IF EXISTS original_language;
+ALTER TABLE movies DROP COLUMN IF EXISTS release_dates;
+ALTER TABLE movies DROP COLUMN IF EXISTS content_rating;
+ALTER TABLE movies DROP COLUMN IF EXISTS content_rating_system;
+ALTER TABLE movies DROP COLUMN IF EXISTS synopsis;
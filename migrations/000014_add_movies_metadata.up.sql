@@ -0,0 +1,20 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS synopsis text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS content_rating_system text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS content_rating text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS release_dates jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS original_language text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS imdb_id text;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS tmdb_id bigint;
+
+-- The external IDs are optional, but no two movies can share one. NULLs don't clash in a
+-- unique constraint, so the movies without them are fine
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_key UNIQUE (imdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_key UNIQUE (tmdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_check CHECK (imdb_id ~ '^tt[0-9]{7,}$');
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_check CHECK (tmdb_id > 0);
+ALTER TABLE movies ADD CONSTRAINT movies_content_rating_check CHECK ((content_rating_system = '') = (content_rating = ''));
+ALTER TABLE movies ADD CONSTRAINT movies_release_dates_check CHECK (jsonb_typeof(release_dates) = 'object');
+
+CREATE INDEX IF NOT EXISTS movies_original_language_idx ON movies (original_language);
+CREATE INDEX IF NOT EXISTS movies_content_rating_idx ON movies (content_rating_system, content_rating);
+CREATE INDEX IF NOT EXISTS movies_release_dates_idx ON movies USING GIN (release_dates);
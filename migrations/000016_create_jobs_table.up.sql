@@ -0,0 +1,23 @@
+-- The background job queue. Workers claim jobs with FOR UPDATE SKIP LOCKED, a running job
+-- whose locked_until has passed was claimed by a worker that died, and is picked up again
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    type text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL,
+    run_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone,
+    last_error text NOT NULL DEFAULT '',
+    finished_at timestamp(0) with time zone,
+    CONSTRAINT jobs_status_check CHECK (status IN ('pending', 'running', 'succeeded', 'dead')),
+    CONSTRAINT jobs_max_attempts_check CHECK (max_attempts > 0)
+);
+
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs (run_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS jobs_running_idx ON jobs (locked_until) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, id);
+
+INSERT INTO permissions (code) VALUES ('jobs:manage') ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_language_check;
+
+ALTER TABLE users DROP COLUMN IF EXISTS language;
@@ -0,0 +1,4 @@
+-- The language the user's emails are sent in, one of the languages in data.Languages
+ALTER TABLE users ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT 'en';
+
+ALTER TABLE users ADD CONSTRAINT users_language_check CHECK (language IN ('en', 'fr', 'de', 'es'));
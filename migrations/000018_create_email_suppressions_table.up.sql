@@ -0,0 +1,9 @@
+-- Addresses we must not send email to, because mail to them bounced or the recipient
+-- complained. The mailer checks this before every send
+CREATE TABLE IF NOT EXISTS email_suppressions (
+    email citext PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    reason text NOT NULL,
+    detail text NOT NULL DEFAULT '',
+    CONSTRAINT email_suppressions_reason_check CHECK (reason IN ('bounce', 'complaint', 'manual'))
+);
@@ -0,0 +1,3 @@
+-- The address a user has asked to change their email to. It only replaces the email once
+-- the user confirms it with the token sent to the new address
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email citext NOT NULL DEFAULT '';
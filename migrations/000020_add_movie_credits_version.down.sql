@@ -0,0 +1 @@
+ALTER TABLE movie_credits DROP COLUMN IF EXISTS version;
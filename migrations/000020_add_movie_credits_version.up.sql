@@ -0,0 +1,2 @@
+-- Credits can be edited in place, the version is used for optimistic locking like movies
+ALTER TABLE movie_credits ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
@@ -0,0 +1,5 @@
+-- The address an email change token was sent to. The change is only confirmed while it is
+-- still the user's pending email, so a token for an address the user has since replaced
+-- can't confirm the new one. Tokens from before this migration have no address and no
+-- longer confirm anything, the user has to ask for the change again
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS email citext NOT NULL DEFAULT '';
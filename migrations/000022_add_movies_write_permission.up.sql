@@ -0,0 +1,3 @@
+-- The permission for changing what is attached to a movie: its artwork, its translations, and
+-- its cast and crew (along with the people they refer to)
+INSERT INTO permissions (code) VALUES ('movies:write') ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,3 @@
+-- The permission for adding addresses to the email suppression list by hand, and lifting
+-- the suppressions
+INSERT INTO permissions (code) VALUES ('emails:manage') ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,40 @@
+// Package migrations embeds the SQL migration files so that the application can tell
+// which schema version it expects. The migrations themselves are still applied with
+// the migrate CLI (see the readme).
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var FS embed.FS
+
+// Latest returns the highest migration version found in the embedded files. The files are
+// named <version>_<name>.<up|down>.sql, as created by `migrate create -seq`
+func Latest() (int64, error) {
+	entries, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+	for _, entry := range entries {
+		prefix, _, found := strings.Cut(entry.Name(), "_")
+		if !found {
+			continue
+		}
+
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		latest = max(latest, version)
+	}
+
+	return latest, nil
+}